@@ -0,0 +1,90 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// MkAnnotation returns the key at which an annotation about `target`
+// can be stored, for example "2/etc/resolv.conf" for "/etc/resolv.conf".
+// The key is prefixed with the depth of the target, so that annotations
+// about a directory and about its contents never collide (the first
+// is a blob at "1/etc", the second lives under "2/etc/"), and the
+// target can always be recovered with ParseAnnotation.
+// Each component of the target is escaped with EscapeKey, so that any
+// target, for example "/src/.git/config", yields a valid key.
+func MkAnnotation(target string) string {
+	target = TreePath(target)
+	if target == "/" {
+		return "0"
+	}
+	depth := len(strings.Split(target, "/"))
+	return path.Join(fmt.Sprintf("%d", depth), escapePath(target))
+}
+
+// ErrMalformedAnnotation is returned by ParseAnnotation for keys which
+// were not generated by MkAnnotation.
+var ErrMalformedAnnotation = errors.New("malformed annotation")
+
+// ParseAnnotation returns the target of the annotation key `annot`,
+// in the format returned by TreePath.
+// If `annot` was not generated by MkAnnotation, ErrMalformedAnnotation
+// is returned.
+func ParseAnnotation(annot string) (string, error) {
+	annot = TreePath(annot)
+	parts := strings.SplitN(annot, "/", 2)
+	depth, err := strconv.Atoi(parts[0])
+	// Only accept the canonical form of the depth: no sign, no
+	// leading zeroes.
+	if err != nil || depth < 0 || strconv.Itoa(depth) != parts[0] {
+		return "", ErrMalformedAnnotation
+	}
+	if len(parts) == 1 {
+		if depth != 0 {
+			return "", ErrMalformedAnnotation
+		}
+		return "/", nil
+	}
+	names := strings.Split(parts[1], "/")
+	if len(names) != depth {
+		return "", ErrMalformedAnnotation
+	}
+	for i, name := range names {
+		// Components of a target are never empty, and never contain
+		// a slash.
+		names[i], err = UnescapeKey(name)
+		if err != nil || names[i] == "" || strings.Contains(names[i], "/") {
+			return "", ErrMalformedAnnotation
+		}
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// walkAnnotations calls `h` for each annotation blob stored in db
+// under `key`, with the target of the annotation.
+// Keys which are not annotations are skipped, and don't abort the walk.
+func (db *DB) walkAnnotations(key string, h func(string, *git.Blob) error) error {
+	if db.Latest() == nil {
+		return nil
+	}
+	if _, err := db.entry(key); err != nil {
+		// No annotations
+		return nil
+	}
+	return db.Walk(key, func(annot string, obj git.Object) error {
+		blob, isBlob := obj.(*git.Blob)
+		if !isBlob {
+			return nil
+		}
+		target, err := ParseAnnotation(annot)
+		if err != nil {
+			return nil
+		}
+		return h(target, blob)
+	})
+}
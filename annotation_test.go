@@ -0,0 +1,96 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestMkAnnotation(t *testing.T) {
+	for target, annot := range map[string]string{
+		"/":                "0",
+		"":                 "0",
+		".":                "0",
+		"foo":              "1/foo",
+		"/foo":             "1/foo",
+		"./foo/":           "1/foo",
+		"/etc/resolv.conf": "2/etc/resolv.conf",
+		"a/./b/../b/c":     "3/a/b/c",
+		"/src/.git/config": "3/src/%2Egit/config",
+		"/tmp/100%":        "2/tmp/100%25",
+	} {
+		if result := MkAnnotation(target); result != annot {
+			t.Fatalf("MkAnnotation(%q): expected %q, got %q", target, annot, result)
+		}
+	}
+}
+
+func TestParseAnnotation(t *testing.T) {
+	for _, target := range []string{"/", "foo", "etc/resolv.conf", "a/b/c/d", "src/.git/config", "a%2Fb/c"} {
+		result, err := ParseAnnotation(MkAnnotation(target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != target {
+			t.Fatalf("expected %q, got %q", target, result)
+		}
+	}
+	for _, annot := range []string{
+		// Not a depth
+		"", "foo", "x/y", "/x", "1a/b",
+		// Declared depth larger than the target
+		"3/a/b", "1", "2/a", "99999999999999999999/a",
+		// Declared depth smaller than the target
+		"1/a/b", "0/extra", "0/a/b/c",
+		// Non-canonical depths
+		"-1/a", "+1/a", "01/a", "00", " 1/a",
+		// Malformed escapes
+		"1/100%", "2/a/%zz", "1/a%2Fb", "2/a/%",
+	} {
+		if _, err := ParseAnnotation(annot); err != ErrMalformedAnnotation {
+			t.Fatalf("ParseAnnotation(%q): expected ErrMalformedAnnotation, got %v", annot, err)
+		}
+	}
+}
+
+func TestWalkAnnotationsIgnoresData(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	// Data keys shaped like annotations, inside and outside the data tree
+	for _, key := range []string{"1/one", "2/a/b", path.Join(DataTree, "1/one")} {
+		if err := db.Set(key, "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Malformed annotations are skipped
+	for _, annot := range []string{"2/one", "01/one", "x"} {
+		if err := db.Set(path.Join(MetaTree, annot), "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set(path.Join(MetaTree, MkAnnotation("one")), "meta"); err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	err = db.walkAnnotations(MetaTree, func(target string, blob *git.Blob) error {
+		targets = append(targets, target)
+		if string(blob.Contents()) != "meta" {
+			t.Fatalf("%s: walked a data blob: %q", target, blob.Contents())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", targets) != "[one]" {
+		t.Fatalf("%v", targets)
+	}
+}
@@ -0,0 +1,277 @@
+package libpack
+
+// Benchmarks for the hot paths of the package. To compare a change
+// against its parent, run on both:
+//
+//	go test -run NONE -bench . -count 10 > bench.txt
+//
+// and compare the results with benchstat. The large value benchmarks
+// write 100MB per iteration: use -benchtime to limit them.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
+)
+
+const largeValueSize = 100 << 20
+
+// benchDB returns a new database in a temporary directory, and a
+// function to release it.
+func benchDB(b *testing.B) (*DB, func()) {
+	tmp, err := ioutil.TempDir("", "bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := Init(tmp, "refs/heads/bench", "")
+	if err != nil {
+		os.RemoveAll(tmp)
+		b.Fatal(err)
+	}
+	return db, func() {
+		db.Free()
+		os.RemoveAll(tmp)
+	}
+}
+
+// looseObjects returns the number of loose objects in the repository of
+// db. libgit2 writes every new object loose, so the difference before
+// and after an operation is the number of objects it wrote.
+func looseObjects(b *testing.B, db *DB) int {
+	objects := path.Join(db.repo.Path(), "objects")
+	dirs, err := ioutil.ReadDir(objects)
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(objects, dir.Name()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		n += len(files)
+	}
+	return n
+}
+
+// reportObjects runs the b.N iterations of `bench`, and reports the
+// number of objects written per iteration.
+func reportObjects(b *testing.B, db *DB, bench func()) {
+	before := looseObjects(b, db)
+	b.ResetTimer()
+	bench()
+	b.StopTimer()
+	b.ReportMetric(float64(looseObjects(b, db)-before)/float64(b.N), "objects/op")
+}
+
+// setWide populates db with `n` keys in the directory `dir`.
+func setWide(b *testing.B, db *DB, dir string, n int) {
+	for i := 0; i < n; i++ {
+		if err := db.Set(fmt.Sprintf("%s/%d", dir, i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSetSmall overwrites a small set of keys over and over.
+func BenchmarkSetSmall(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Set(fmt.Sprintf("key%d", i%100), fmt.Sprintf("%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetSmall(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	setWide(b, db, "dir", 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(fmt.Sprintf("dir/%d", i%100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSetDeep sets keys 10 levels deep, and reports the number of
+// objects written along with the time.
+func BenchmarkSetDeep(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	b.ReportAllocs()
+	reportObjects(b, db, func() {
+		for i := 0; i < b.N; i++ {
+			key := fmt.Sprintf("a/b/c/d/e/f/g/h/%d/%d", i%100, i)
+			if err := db.Set(key, "value"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSetWide adds keys to a directory of 10000 entries.
+func BenchmarkSetWide(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	setWide(b, db, "dir", 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Set(fmt.Sprintf("dir/new%d", i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSetFlat and BenchmarkSetManyFlat store 10000 keys in one
+// directory, one by one and at once. They report the number of objects
+// written along with the time.
+func BenchmarkSetFlat(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	b.ReportAllocs()
+	reportObjects(b, db, func() {
+		for i := 0; i < b.N; i++ {
+			setWide(b, db, fmt.Sprintf("dir%d", i), 10000)
+		}
+	})
+}
+
+func BenchmarkSetManyFlat(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	b.ReportAllocs()
+	reportObjects(b, db, func() {
+		for i := 0; i < b.N; i++ {
+			values := make(map[string]string, 10000)
+			for j := 0; j < 10000; j++ {
+				values[fmt.Sprintf("dir%d/%d", i, j)] = "value"
+			}
+			if err := db.SetMany(values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkListWide(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	setWide(b, db, "dir", 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.List("dir"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCommit(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	setWide(b, db, "dir", 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Set("counter", fmt.Sprintf("%d", i)); err != nil {
+			b.Fatal(err)
+		}
+		if err := db.Commit("bench"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetLarge(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	value := string(make([]byte, largeValueSize))
+	b.SetBytes(largeValueSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Vary the value so that a new blob is written each time
+		if err := db.Set("large", fmt.Sprintf("%010d", i)+value[10:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetLarge(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	if err := db.SetStream("large", io.LimitReader(zeroReader{}, largeValueSize)); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(largeValueSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get("large"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetStreamLarge(b *testing.B) {
+	db, cleanup := benchDB(b)
+	defer cleanup()
+	b.SetBytes(largeValueSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src := io.MultiReader(bytes.NewReader([]byte(fmt.Sprintf("%d", i))), io.LimitReader(zeroReader{}, largeValueSize))
+		if err := db.SetStream("large", src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSetTar imports an archive of 1000 small files.
+func BenchmarkSetTar(b *testing.B) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < 1000; i++ {
+		data := fmt.Sprintf("file %d", i)
+		hdr := &tar.Header{Name: fmt.Sprintf("dir%d/file%d", i%10, i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, cleanup := benchDB(b)
+		b.StartTimer()
+		if err := db.SetTar(bytes.NewReader(buf.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		cleanup()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,178 @@
+package libpack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Large files can be stored in chunks (see TarOptions.ChunkThreshold).
+// The file is split at boundaries defined by its content, using a
+// rolling hash, so that a modification only changes the chunks around
+// it: the other chunks are the same blobs as before, and are stored
+// only once.
+//
+// The data of a chunked file is a tree of chunk blobs, named after
+// their position ("00000000", "00000001"...), and the "chunked"
+// attribute of the file records the chunking method.
+const (
+	chunkMethod  = "gear"
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 4 << 20
+	// A boundary is found when the top chunkBits bits of the hash are
+	// zero, which gives chunks of 2^chunkBits bytes on average.
+	chunkBits = 20
+)
+
+// gearTable maps each byte to a random value for the rolling hash.
+var gearTable [256]uint64
+
+func init() {
+	// The table must never change, or the chunks of files stored
+	// before would no longer match: generate it with splitmix64
+	// from a fixed seed.
+	var x uint64 = 0x6c69627061636b // "libpack"
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream in content-defined chunks.
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(src io.Reader) *chunker {
+	return &chunker{r: bufio.NewReader(src), buf: make([]byte, 0, chunkMaxSize)}
+}
+
+// next returns the next chunk of the stream, or io.EOF at the end.
+// The chunk is only valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var h uint64
+	for len(c.buf) < chunkMaxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		h = (h << 1) + gearTable[b]
+		if len(c.buf) >= chunkMinSize && h>>(64-chunkBits) == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// storeChunked stores the content of the regular file `name`, read
+// from `src`, in chunks. `stats` counts each chunk as a blob.
+func (db *DB) storeChunked(name string, src io.Reader, size int64, stats *ImportStats) error {
+	stats.Files++
+	stats.Bytes += size
+	builder, err := db.repo.TreeBuilder()
+	if err != nil {
+		return err
+	}
+	defer builder.Free()
+	c := newChunker(src)
+	for i := 0; ; i++ {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		id, err := db.storeBytes(chunk, stats)
+		if err != nil {
+			return err
+		}
+		if err := builder.Insert(fmt.Sprintf("%08d", i), id, 0100644); err != nil {
+			return err
+		}
+	}
+	treeId, err := builder.Write()
+	if err != nil {
+		return err
+	}
+	// Setting a tree merges it with the existing one: remove the
+	// chunks of a previous version of the file first.
+	key := dataPath(name)
+	if err := db.Delete(key); err != nil {
+		return err
+	}
+	if err := db.setId(key, treeId, 040000); err != nil {
+		return err
+	}
+	return db.Set(attrPath(name, "chunked"), chunkMethod)
+}
+
+// chunks returns the chunks of the chunked file `name`, whose data is
+// the tree `tree`.
+func (db *DB) chunks(name string, tree *git.Tree) ([]*git.Oid, error) {
+	method, err := db.Get(attrPath(name, "chunked"))
+	if err != nil {
+		return nil, fmt.Errorf("regular file stored as a tree")
+	}
+	if method != chunkMethod {
+		return nil, fmt.Errorf("unknown chunking method: %s", method)
+	}
+	var chunks []*git.Oid
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		chunks = append(chunks, tree.EntryByIndex(i).Id)
+	}
+	return chunks, nil
+}
+
+// chunkedSize returns the total size of the chunks of the chunked file
+// `name`, whose data is the tree `tree`.
+func (db *DB) chunkedSize(name string, tree *git.Tree) (int64, error) {
+	chunks, err := db.chunks(name, tree)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, id := range chunks {
+		blob, err := db.lookupBlob(id)
+		if err != nil {
+			return 0, fmt.Errorf("chunk %v: %v", id, err)
+		}
+		size += blob.Size()
+		blob.Free()
+	}
+	return size, nil
+}
+
+// copyChunks streams the contents of the blobs `chunks` to `dst`, and
+// returns an error if they are not exactly `size` bytes long in total.
+func (db *DB) copyChunks(dst io.Writer, chunks []*git.Oid, size int64) error {
+	var total int64
+	for _, id := range chunks {
+		src, err := db.openBlob(id)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(dst, src)
+		src.Close()
+		total += n
+		if err != nil {
+			return err
+		}
+	}
+	if total != size {
+		return fmt.Errorf("chunks are %d bytes, expected %d", total, size)
+	}
+	return nil
+}
@@ -6,7 +6,7 @@ import (
 	"os"
 	"strings"
 
-	"github.com/docker/libpack/db"
+	"github.com/docker/libpack"
 )
 
 const (
@@ -18,13 +18,48 @@ func main() {
 	app.Name = "cfg"
 	app.Usage = "A simple command-line interface to git-backed config"
 	app.Version = "0.0.1"
-	app.Flags = []cli.Flag{}
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "ref", Value: DefaultRef, Usage: "git reference holding the config"},
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "set",
 			Usage:  "",
 			Action: cmdSet,
 		},
+		{
+			Name:   "get",
+			Usage:  "",
+			Action: cmdGet,
+		},
+		{
+			Name:   "list",
+			Usage:  "",
+			Action: cmdList,
+		},
+		{
+			Name:  "dump",
+			Usage: "",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "json", Usage: "dump as a JSON object"},
+			},
+			Action: cmdDump,
+		},
+		{
+			Name:   "count",
+			Usage:  "",
+			Action: cmdCount,
+		},
+		{
+			Name:   "size",
+			Usage:  "",
+			Action: cmdSize,
+		},
+		{
+			Name:   "delete",
+			Usage:  "",
+			Action: cmdDelete,
+		},
 	}
 	app.Run(os.Args)
 }
@@ -33,7 +68,7 @@ func cmdSet(c *cli.Context) {
 	if !c.Args().Present() {
 		Fatalf("usage: set KEY=VALUE...")
 	}
-	db, err := db.Init(".git", DefaultRef, "")
+	db, err := libpack.Init(".git", c.GlobalString("ref"), "")
 	if err != nil {
 		Fatalf("init: %v", err)
 	}
@@ -52,6 +87,108 @@ func cmdSet(c *cli.Context) {
 		Fatalf("commit: %v", err)
 	}
 }
+
+func cmdGet(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: get KEY")
+	}
+	val, err := open(c).Get(c.Args()[0])
+	if os.IsNotExist(err) {
+		Fatalf("get: %s: no such key", c.Args()[0])
+	} else if err != nil {
+		Fatalf("get: %v", err)
+	}
+	fmt.Println(val)
+}
+
+func cmdList(c *cli.Context) {
+	if len(c.Args()) > 1 {
+		Fatalf("usage: list [PREFIX]")
+	}
+	prefix := c.Args().First()
+	names, err := open(c).List(prefix)
+	if os.IsNotExist(err) {
+		Fatalf("list: %s: no such key", prefix)
+	} else if err != nil {
+		Fatalf("list: %v", err)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+func cmdDump(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		Fatalf("usage: dump [--json]")
+	}
+	db := open(c)
+	dump := db.Dump
+	if c.Bool("json") {
+		dump = db.DumpJSON
+	}
+	if err := dump(os.Stdout); err != nil {
+		Fatalf("dump: %v", err)
+	}
+}
+
+func cmdCount(c *cli.Context) {
+	if len(c.Args()) > 1 {
+		Fatalf("usage: count [PREFIX]")
+	}
+	prefix := c.Args().First()
+	n, err := open(c).Count(prefix)
+	if os.IsNotExist(err) {
+		Fatalf("count: %s: no such key", prefix)
+	} else if err != nil {
+		Fatalf("count: %v", err)
+	}
+	fmt.Println(n)
+}
+
+func cmdSize(c *cli.Context) {
+	if len(c.Args()) > 1 {
+		Fatalf("usage: size [PREFIX]")
+	}
+	prefix := c.Args().First()
+	size, err := open(c).TotalSize(prefix)
+	if os.IsNotExist(err) {
+		Fatalf("size: %s: no such key", prefix)
+	} else if err != nil {
+		Fatalf("size: %v", err)
+	}
+	fmt.Println(size)
+}
+
+func cmdDelete(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: delete KEY")
+	}
+	key := c.Args()[0]
+	db := open(c)
+	// Delete succeeds on missing keys: check first, so that a typo
+	// is reported.
+	if exists, err := db.Exists(key); err != nil {
+		Fatalf("delete: %v", err)
+	} else if !exists {
+		Fatalf("delete: %s: no such key", key)
+	}
+	if err := db.Delete(key); err != nil {
+		Fatalf("delete: %v", err)
+	}
+	if err := db.Commit(fmt.Sprintf("delete %s", key)); err != nil {
+		Fatalf("commit: %v", err)
+	}
+}
+
+// open opens the existing config database.
+func open(c *cli.Context) *libpack.DB {
+	db, err := libpack.Open(".git", c.GlobalString("ref"), "")
+	if err != nil {
+		Fatalf("open: %v", err)
+	}
+	return db
+}
+
 func Fatalf(msg string, args ...interface{}) {
 	if !strings.HasSuffix(msg, "\n") {
 		msg = msg + "\n"
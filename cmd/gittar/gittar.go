@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -8,7 +10,17 @@ import (
 )
 
 func main() {
-	err := libpack.Git2tar(os.Args[1], os.Args[2], os.Stdout)
+	scope := flag.String("scope", "", "export only the subtree at PATH")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--scope PATH] REPO HASH|REF\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := libpack.Git2tar(flag.Arg(0), flag.Arg(1), *scope, os.Stdout)
 	if err != nil {
 		log.Fatal(err)
 	}
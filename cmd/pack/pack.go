@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/docker/docker/archive"
 	"github.com/docker/libpack"
+	git "github.com/libgit2/git2go"
+
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
 )
 
 func main() {
@@ -17,17 +22,62 @@ func main() {
 	app.Name = "pack"
 	app.Usage = "A simple command-line interface to libpack"
 	app.Version = "0.0.1"
-	app.Flags = []cli.Flag{}
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "repo", Value: ".git", Usage: "path to the git repository"},
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "unpack",
 			Usage:  "",
 			Action: cmdUnpack,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "p", Usage: "restore file ownership (as root) and modification times"},
+			},
+		},
+		{
+			Name:   "verify",
+			Usage:  "",
+			Action: cmdVerify,
 		},
 		{
 			Name:   "pack",
 			Usage:  "",
 			Action: cmdPack,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{Name: "x", Value: &cli.StringSlice{}, Usage: "exclude files matching PATTERN"},
+				cli.StringSliceFlag{Name: "i", Value: &cli.StringSlice{}, Usage: "only include files matching PATTERN"},
+				cli.BoolFlag{Name: "L", Usage: "follow symlinks, like tar -h"},
+			},
+		},
+		{
+			Name:   "log",
+			Usage:  "",
+			Action: cmdLog,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "ref", Value: "refs/heads/master", Usage: "reference to show"},
+				cli.IntFlag{Name: "n", Usage: "show at most N commits"},
+			},
+		},
+		{
+			Name:   "ls",
+			Usage:  "",
+			Action: cmdLs,
+		},
+		{
+			Name:   "push",
+			Usage:  "",
+			Action: cmdPush,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "ref", Value: "refs/heads/master", Usage: "reference to push"},
+			},
+		},
+		{
+			Name:   "pull",
+			Usage:  "",
+			Action: cmdPull,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "ref", Value: "refs/heads/master", Usage: "reference to pull"},
+			},
 		},
 	}
 	app.Run(os.Args)
@@ -35,24 +85,147 @@ func main() {
 
 func cmdUnpack(c *cli.Context) {
 	if !c.Args().Present() {
-		Fatalf("usage: unpack HASH")
+		Fatalf("usage: unpack [-p] HASH")
+	}
+	opts := &UnpackOptions{
+		Progress:          progressMeter(),
+		PreserveOwnership: c.Bool("p"),
+		PreserveTimes:     c.Bool("p"),
 	}
-	if err := Unpack(".git", ".", c.Args()[0]); err != nil {
+	if err := Unpack(c.GlobalString("repo"), ".", c.Args()[0], opts); err != nil {
 		Fatalf("unpack: %v", err)
 	}
 }
 
+func cmdVerify(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: verify HASH")
+	}
+	db, err := libpack.OpenTree(c.GlobalString("repo"), c.Args()[0], "")
+	if err != nil {
+		Fatalf("verify: %v", err)
+	}
+	defer db.Free()
+	if err := libpack.ValidateTarTree(db); err != nil {
+		Fatalf("verify: %v", err)
+	}
+}
+
 func cmdPack(c *cli.Context) {
 	if len(c.Args()) != 1 {
-		Fatalf("usage: pack BRANCH")
+		Fatalf("usage: pack [-x PATTERN]... [-i PATTERN]... [-L] BRANCH")
+	}
+	opts := &PackOptions{
+		Excludes:       c.StringSlice("x"),
+		Includes:       c.StringSlice("i"),
+		FollowSymlinks: c.Bool("L"),
+		Progress:       progressMeter(),
+		Stats:          &libpack.ImportStats{},
 	}
-	hash, err := Pack(".git", ".", c.Args()[0])
+	hash, err := Pack(c.GlobalString("repo"), ".", c.Args()[0], opts)
 	if err != nil {
 		Fatalf("pack: %v", err)
 	}
+	fmt.Fprintf(os.Stderr, "%d files, %d bytes: %d new blobs (%d bytes), %d reused\n",
+		opts.Stats.Files, opts.Stats.Bytes, opts.Stats.NewBlobs, opts.Stats.BytesWritten, opts.Stats.ReusedBlobs)
 	fmt.Println(hash)
 }
 
+func cmdLog(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		Fatalf("usage: log [--ref REF] [-n N]")
+	}
+	db, err := libpack.Open(c.GlobalString("repo"), c.String("ref"), "")
+	if err != nil {
+		Fatalf("log: %v", err)
+	}
+	defer db.Free()
+	entries, err := db.Log(c.Int("n"))
+	if err != nil {
+		Fatalf("log: %v", err)
+	}
+	for _, e := range entries {
+		fmt.Printf("%s %s %s\n", e.Id, e.Time.Format(time.RFC3339), strings.SplitN(e.Message, "\n", 2)[0])
+	}
+}
+
+func cmdLs(c *cli.Context) {
+	if len(c.Args()) < 1 || len(c.Args()) > 2 {
+		Fatalf("usage: ls HASH [PATH]")
+	}
+	db, err := libpack.OpenTree(c.GlobalString("repo"), c.Args()[0], "")
+	if err != nil {
+		Fatalf("ls: %v", err)
+	}
+	defer db.Free()
+	dir := "/"
+	if len(c.Args()) == 2 {
+		dir = c.Args()[1]
+	}
+	names, err := db.ListTar(dir)
+	if err != nil {
+		Fatalf("ls: %s: no such directory", dir)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+func cmdPush(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: push [--ref REF] URL")
+	}
+	db, err := libpack.Open(c.GlobalString("repo"), c.String("ref"), "")
+	if err != nil {
+		Fatalf("push: %v", err)
+	}
+	defer db.Free()
+	old, err := db.Push(c.Args()[0])
+	if err != nil {
+		Fatalf("push: %v", err)
+	}
+	fmt.Printf("%s %s\n", oidString(old), oidString(db.Head()))
+}
+
+func cmdPull(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: pull [--ref REF] URL")
+	}
+	db, err := libpack.Init(c.GlobalString("repo"), c.String("ref"), "")
+	if err != nil {
+		Fatalf("pull: %v", err)
+	}
+	defer db.Free()
+	old := oidString(db.Head())
+	if err := db.Pull(c.Args()[0]); err != nil {
+		Fatalf("pull: %v", err)
+	}
+	fmt.Printf("%s %s\n", old, oidString(db.Head()))
+}
+
+// oidString formats `id` for display, with zeroes for no id.
+func oidString(id *git.Oid) string {
+	if id == nil {
+		return strings.Repeat("0", 40)
+	}
+	return id.String()
+}
+
+// progressMeter returns a progress callback rendering a simple counter
+// on stderr, or nil if stderr is not a terminal.
+func progressMeter() func(libpack.ProgressEvent) {
+	if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return func(e libpack.ProgressEvent) {
+		if e.TotalFiles > 0 {
+			fmt.Fprintf(os.Stderr, "\r%d/%d files, %d bytes", e.Files, e.TotalFiles, e.Bytes)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%d files, %d bytes", e.Files, e.Bytes)
+		}
+	}
+}
+
 func Fatalf(msg string, args ...interface{}) {
 	if !strings.HasSuffix(msg, "\n") {
 		msg = msg + "\n"
@@ -61,17 +234,44 @@ func Fatalf(msg string, args ...interface{}) {
 	os.Exit(1)
 }
 
-func Pack(repo, dir, branch string) (hash string, err error) {
+// PackOptions configures which files Pack stores.
+type PackOptions struct {
+	// Excludes and Includes are as in libpack.DirOptions.
+	// ".git" is always excluded.
+	Excludes []string
+	Includes []string
+	// FollowSymlinks packs the files and directories which symlinks
+	// point to, including the directory itself, instead of the
+	// symlinks, like `tar -h`.
+	FollowSymlinks bool
+	// Progress, if set, is called after each file is stored.
+	Progress func(libpack.ProgressEvent)
+	// Stats, if set, receives the statistics of the import.
+	Stats *libpack.ImportStats
+}
+
+func Pack(repo, dir, branch string, opts *PackOptions) (hash string, err error) {
+	if opts == nil {
+		opts = &PackOptions{}
+	}
 	db, err := libpack.Init(repo, branch, "")
 	if err != nil {
 		return "", err
 	}
-	a, err := archive.TarWithOptions(dir, &archive.TarOptions{Excludes: []string{".git"}})
+	stats, err := db.SetDir(dir, &libpack.DirOptions{
+		Excludes:       append([]string{".git"}, opts.Excludes...),
+		Includes:       opts.Includes,
+		FollowSymlinks: opts.FollowSymlinks,
+		Progress:       opts.Progress,
+	})
 	if err != nil {
 		return "", err
 	}
-	if err := db.SetTar(a); err != nil {
-		return "", err
+	if opts.Progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if opts.Stats != nil {
+		*opts.Stats = *stats
 	}
 	if err := db.Commit("imported tar filesystem tree"); err != nil {
 		return "", err
@@ -83,7 +283,22 @@ func Pack(repo, dir, branch string) (hash string, err error) {
 	return
 }
 
-func Unpack(repo, dir, hash string) error {
+// UnpackOptions configures how Unpack extracts files.
+type UnpackOptions struct {
+	// Progress, if set, is called after each file is extracted.
+	Progress func(libpack.ProgressEvent)
+	// PreserveOwnership restores the owner and group stored for each
+	// file. It is silently skipped unless running as root.
+	PreserveOwnership bool
+	// PreserveTimes restores the modification time stored for each
+	// file, except symlinks.
+	PreserveTimes bool
+}
+
+func Unpack(repo, dir, hash string, opts *UnpackOptions) error {
+	if opts == nil {
+		opts = &UnpackOptions{}
+	}
 	db, err := libpack.Init(repo, hash, "")
 	if err != nil {
 		return err
@@ -96,20 +311,77 @@ func Unpack(repo, dir, hash string) error {
 	var tasks sync.WaitGroup
 	tasks.Add(2)
 	go func() {
-		inErr = db.GetTar(os.Stdout)
-		w.Close()
+		inErr = db.GetTarWithOptions(w, &libpack.TarOptions{Progress: opts.Progress})
+		// Propagate the producer error (or EOF) to the consumer
+		w.CloseWithError(inErr)
 		tasks.Done()
 	}()
 	go func() {
 		outErr = archive.Untar(r, dir, &archive.TarOptions{})
+		// Unblock the producer if the consumer gave up early
+		r.CloseWithError(outErr)
 		tasks.Done()
 	}()
 	tasks.Wait()
+	if opts.Progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
 	if inErr != nil {
 		return fmt.Errorf("git2tar: %v", inErr)
 	}
 	if outErr != nil {
 		return fmt.Errorf("untar: %v", outErr)
 	}
+	if opts.PreserveOwnership || opts.PreserveTimes {
+		headers, err := db.TarHeaders()
+		if err != nil {
+			return err
+		}
+		if err := restoreAttrs(dir, headers, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAttrs applies the ownership and times of `headers` to the
+// files extracted in `dir`, as selected by `opts`.
+// Directories are handled last, so that their times are not changed
+// by the extraction of their contents.
+func restoreAttrs(dir string, headers []*tar.Header, opts *UnpackOptions) error {
+	chown := opts.PreserveOwnership && os.Geteuid() == 0
+	var dirs []*tar.Header
+	apply := func(hdr *tar.Header) error {
+		name := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if chown {
+			if err := os.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if opts.PreserveTimes && hdr.Typeflag != tar.TypeSymlink {
+			atime := hdr.AccessTime
+			if atime.IsZero() {
+				atime = hdr.ModTime
+			}
+			if err := os.Chtimes(name, atime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+			continue
+		}
+		if err := apply(hdr); err != nil {
+			return err
+		}
+	}
+	for _, hdr := range dirs {
+		if err := apply(hdr); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/docker/libpack"
+)
+
+// Docker stores file capabilities, which are an extended attribute:
+// pack must store them too.
+func TestPackSameAsTarCapabilities(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	writeFile(t, path.Join(src, "server"), "bind")
+	// Version 2 capabilities, with cap_net_bind_service permitted
+	capability := "\x01\x00\x00\x02\x00\x04\x00\x00" + strings.Repeat("\x00", 12)
+	if err := syscall.Setxattr(path.Join(src, "server"), "security.capability", []byte(capability), 0); err != nil {
+		t.Skipf("can't set capabilities: %v", err)
+	}
+	assertPackSameAsTar(t, repo, src, nil)
+	db, err := libpack.Open(repo, "refs/heads/dir", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	headers, err := db.TarHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hdr := range headers {
+		if hdr.Name == "server" && hdr.Xattrs["security.capability"] == "" {
+			t.Fatalf("capabilities were not stored")
+		}
+	}
+}
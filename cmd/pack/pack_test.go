@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/archive"
+	"github.com/docker/libpack"
+)
+
+func tmpdir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFile(t *testing.T, name, content string) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Fatalf("%s: expected %q, got %q", name, content, data)
+	}
+}
+
+func TestPackUnpack(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	dst := path.Join(tmp, "dst")
+	writeFile(t, path.Join(src, "hello"), "world")
+	writeFile(t, path.Join(src, "a/b/c"), "nested")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Pack(repo, src, "refs/heads/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unpack(repo, dst, "refs/heads/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path.Join(dst, "hello"), "world")
+	assertFile(t, path.Join(dst, "a/b/c"), "nested")
+}
+
+// Only the top-level .git is excluded: nested ones are packed.
+func TestPackNestedGit(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	dst := path.Join(tmp, "dst")
+	writeFile(t, path.Join(src, "vendor/dep/.git/config"), "conf")
+	writeFile(t, path.Join(src, "vendor/dep/main.go"), "main")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Pack(repo, src, "refs/heads/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unpack(repo, dst, "refs/heads/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path.Join(dst, "vendor/dep/.git/config"), "conf")
+	assertFile(t, path.Join(dst, "vendor/dep/main.go"), "main")
+}
+
+func TestPackExcludes(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	writeFile(t, path.Join(src, "index.js"), "main")
+	writeFile(t, path.Join(src, "node_modules/dep/index.js"), "dep")
+	writeFile(t, path.Join(src, "build.o"), "obj")
+	opts := &PackOptions{Excludes: []string{"node_modules", "*.o"}}
+	if _, err := Pack(repo, src, "refs/heads/test", opts); err != nil {
+		t.Fatal(err)
+	}
+	db, err := libpack.Open(repo, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	names, err := db.List(libpack.DataTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", names) != "[index.js]" {
+		t.Fatalf("%v", names)
+	}
+}
+
+func TestPackFollowSymlinks(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	dst := path.Join(tmp, "dst")
+	writeFile(t, path.Join(tmp, "outside/dir/file"), "nested")
+	writeFile(t, path.Join(src, "hello"), "world")
+	for link, target := range map[string]string{
+		"dir":   "../outside/dir",
+		"alias": "hello",
+	} {
+		if err := os.Symlink(target, path.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The directory itself is followed too
+	if err := os.Symlink("src", path.Join(tmp, "root")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := &PackOptions{FollowSymlinks: true}
+	if _, err := Pack(repo, path.Join(tmp, "root"), "refs/heads/test", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unpack(repo, dst, "refs/heads/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alias", "dir", "dir/file"} {
+		if fi, err := os.Lstat(path.Join(dst, name)); err != nil {
+			t.Fatal(err)
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			t.Fatalf("%s was stored as a symlink", name)
+		}
+	}
+	assertFile(t, path.Join(dst, "alias"), "world")
+	assertFile(t, path.Join(dst, "dir/file"), "nested")
+	// A symlink to a parent directory would never end
+	if err := os.Symlink("..", path.Join(src, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Pack(repo, src, "refs/heads/loop", opts); err == nil {
+		t.Fatalf("packing a symlink loop should fail")
+	}
+}
+
+func TestUnpackPreserveTimes(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	dst := path.Join(tmp, "dst")
+	writeFile(t, path.Join(src, "a/b"), "old")
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, name := range []string{"a/b", "a"} {
+		if err := os.Chtimes(path.Join(src, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Pack(repo, src, "refs/heads/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Ownership is restored as root only: elsewhere it must not fail.
+	opts := &UnpackOptions{PreserveOwnership: true, PreserveTimes: true}
+	if err := Unpack(repo, dst, "refs/heads/test", opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b", "a"} {
+		fi, err := os.Stat(path.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Fatalf("%s: mtime is %v, expected %v", name, fi.ModTime(), mtime)
+		}
+	}
+}
+
+func TestPackSameAsTar(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	repo := path.Join(tmp, "repo")
+	src := path.Join(tmp, "src")
+	writeFile(t, path.Join(src, "hello"), "world")
+	writeFile(t, path.Join(src, "empty"), "")
+	writeFile(t, path.Join(src, "a/b/c"), "nested")
+	writeFile(t, path.Join(src, "a/skip.o"), "obj")
+	if err := os.MkdirAll(path.Join(src, "emptydir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(src, "hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a/b/c", path.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	assertPackSameAsTar(t, repo, src, []string{"a/*.o"})
+}
+
+// assertPackSameAsTar checks that packing `src` stores the same tree as
+// importing the archive of `src` produced by docker, with `excludes`.
+func assertPackSameAsTar(t *testing.T, repo, src string, excludes []string) {
+	opts := &PackOptions{Excludes: excludes}
+	if _, err := Pack(repo, src, "refs/heads/dir", opts); err != nil {
+		t.Fatal(err)
+	}
+	a, err := archive.TarWithOptions(src, &archive.TarOptions{Excludes: append([]string{".git"}, excludes...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarTree, err := libpack.Tar2git(a, repo, "refs/heads/tar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := libpack.Open(repo, "refs/heads/dir", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	commit, err := db.Repo().LookupCommit(db.Head())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer commit.Free()
+	if dirTree := commit.TreeId().String(); dirTree != tarTree {
+		t.Fatalf("pack stored tree %s, tar import stored %s", dirTree, tarTree)
+	}
+}
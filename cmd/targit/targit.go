@@ -1,15 +1,31 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/docker/libpack"
 )
 
 func main() {
-	result, err := libpack.Tar2git(os.Stdin, os.Args[1])
+	scope := flag.String("scope", "", "import into the subtree at PATH")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--scope PATH] REPO [BRANCH]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	branch := flag.Arg(1)
+	if branch != "" && !strings.HasPrefix(branch, "refs/") {
+		branch = "refs/heads/" + branch
+	}
+	result, err := libpack.Tar2git(os.Stdin, flag.Arg(0), branch, *scope)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,19 +1,34 @@
 package libpack
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	git "github.com/libgit2/git2go"
 )
 
+// emptyBlobId is the id of the empty git blob.
+const emptyBlobId = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+
 // DB is a simple git-backed database.
+//
+// A DB, and the databases scoped from it, may be used concurrently by
+// several goroutines: each operation sees and updates the current tree
+// atomically. Sequences of operations are not atomic: for example a
+// concurrent Commit may include only some of the keys written by a
+// SetTar in progress.
+// Several DBs may be opened on the same repository, but not on the same
+// reference: they don't coordinate their commits.
 type DB struct {
 	repo   *git.Repository
 	commit *git.Commit
@@ -21,20 +36,37 @@ type DB struct {
 	scope  string
 	tree   *git.Tree
 	parent *DB
+	logger Logger
+	clock  func() time.Time
+	merge  MergeStrategy
+	// mu protects commit and tree. Only the lock of the root
+	// database is used.
+	mu sync.RWMutex
 }
 
+// Scope returns a database exposing the subtree `scope` of db.
+// The scoped database shares the state of db: changes made through
+// either are visible in both, and committed together. It doesn't own
+// any resource: freeing it is not necessary, and has no effect.
 func (db *DB) Scope(scope string) *DB {
-	// FIXME: do we risk duplicate db.repo.Free()?
 	return &DB{
-		repo: db.repo,
-		commit: db.commit,
-		ref: db.ref,
-		scope: scope, // If parent!=nil, scope is relative to parent
-		tree: db.tree,
+		repo:   db.repo,
+		ref:    db.ref,
+		scope:  scope, // If parent!=nil, scope is relative to parent
 		parent: db,
 	}
 }
 
+// root returns the database which db was scoped from, or db itself.
+// The root database holds the current commit and tree, and owns all
+// git objects.
+func (db *DB) root() *DB {
+	for db.parent != nil {
+		db = db.parent
+	}
+	return db
+}
+
 // Init initializes a new git-backed database from the following
 // elements:
 // * A bare git repository at `repo`
@@ -81,51 +113,108 @@ func newRepo(repo *git.Repository, ref, scope string) (*DB, error) {
 // in use.
 // This is required in addition to Golang garbage collection, because
 // of the libgit2 C bindings.
+// The repository returned by Repo is freed as well.
 func (db *DB) Free() {
-	db.repo.Free()
+	if db.parent != nil {
+		// Scoped databases don't own anything
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if db.commit != nil {
 		db.commit.Free()
+		db.commit = nil
 	}
+	db.setTree(nil)
+	db.repo.Free()
 }
 
 // Head returns the id of the latest commit
 func (db *DB) Head() *git.Oid {
-	if db.commit != nil {
-		return db.commit.Id()
+	root := db.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	if root.commit != nil {
+		return root.commit.Id()
 	}
 	return nil
 }
 
+// Latest returns the id of the current tree, including uncommitted
+// changes.
 func (db *DB) Latest() *git.Oid {
-	if db.tree != nil {
-		return db.tree.Id()
+	root := db.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	if root.tree != nil {
+		return root.tree.Id()
 	}
 	return nil
 }
 
+// Repo returns the git repository of db. It is owned by db, and
+// must not be freed by the caller.
 func (db *DB) Repo() *git.Repository {
 	return db.repo
 }
 
+// setTree replaces the current tree of db with `tree`, and frees the
+// previous one. db takes ownership of `tree`.
+// The caller must hold the write lock of db.
+func (db *DB) setTree(tree *git.Tree) {
+	if db.tree != nil && db.tree != tree {
+		db.tree.Free()
+	}
+	db.tree = tree
+}
+
+// Dump writes a listing of db to `dst`, with the contents of each
+// value. Symlinks are listed with their target.
 func (db *DB) Dump(dst io.Writer) error {
 	return db.Walk("/", func(key string, obj git.Object) error {
 		if _, isTree := obj.(*git.Tree); isTree {
 			fmt.Fprintf(dst, "%s/\n", key)
 		} else if blob, isBlob := obj.(*git.Blob); isBlob {
-			fmt.Fprintf(dst, "%s = %s\n", key, blob.Contents())
+			if e, err := db.entry(key); err == nil && e.Filemode == 0120000 {
+				fmt.Fprintf(dst, "%s -> %s\n", key, blob.Contents())
+			} else {
+				fmt.Fprintf(dst, "%s = %s\n", key, blob.Contents())
+			}
 		}
 		return nil
 	})
 }
 
+// SkipTree can be returned by the handler passed to Walk, to skip the
+// contents of the subtree it was called with.
+var SkipTree = errors.New("skip this tree")
+
+// Walk calls `h` for each object under `key`, with its path relative to
+// `key`. The object is freed when `h` returns, and must not be retained.
+// Paths are clean and slash-separated, and never start with a slash:
+// walking "a" yields "b" and "b/c", as does walking "/a/", and walking
+// the root yields "a", "a/b" and "a/b/c".
+// If nothing was stored in db yet, walking its root yields nothing, and
+// walking any other key returns ErrNotExist.
 func (db *DB) Walk(key string, h func(string, git.Object) error) error {
-	if db.tree == nil {
-		return fmt.Errorf("no tree to walk")
+	p, err := db.fullPath(key)
+	if err != nil {
+		return err
 	}
-	subtree, err := lookupSubtree(db.repo, db.tree, key)
+	// The subtree is a copy: the database is not locked while walking,
+	// so that `h` may use it.
+	subtree, err := db.currentSubtree(p)
 	if err != nil {
 		return err
 	}
+	if subtree == nil {
+		// Nothing was stored yet: the root is walked as an empty tree
+		if p == "/" {
+			return nil
+		}
+		return notExist(key)
+	}
+	defer subtree.Free()
 	var handlerErr error
 	err = subtree.Walk(func(parent string, e *git.TreeEntry) int {
 		obj, err := db.repo.Lookup(e.Id)
@@ -133,11 +222,14 @@ func (db *DB) Walk(key string, h func(string, git.Object) error) error {
 			handlerErr = err
 			return -1
 		}
-		if err := h(path.Join(parent, e.Name), obj); err != nil {
+		err = h(path.Join(parent, e.Name), obj)
+		obj.Free()
+		if err == SkipTree {
+			return 1
+		} else if err != nil {
 			handlerErr = err
 			return -1
 		}
-		obj.Free()
 		return 0
 	})
 	if handlerErr != nil {
@@ -154,11 +246,32 @@ func (db *DB) Walk(key string, h func(string, git.Object) error) error {
 // Uncommitted changes are left untouched (ie they are not merged
 // or rebased).
 func (db *DB) Update() error {
-	tip, err := db.repo.LookupReference(db.ref)
-	if err != nil {
+	if db.parent != nil {
+		return db.parent.Update()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.update()
+}
+
+// update is Update for the root database, with its write lock held.
+func (db *DB) update() error {
+	var tip *git.Reference
+	if db.ref != "" {
+		var err error
+		if tip, err = db.repo.LookupReference(db.ref); err != nil && !IsNoRef(err) {
+			return fmt.Errorf("%s: %v", db.ref, err)
+		}
+	}
+	if tip == nil {
+		// Nothing committed yet
+		if db.commit != nil {
+			db.commit.Free()
+		}
 		db.commit = nil
 		return nil
 	}
+	defer tip.Free()
 	commit, err := db.lookupCommit(tip.Target())
 	if err != nil {
 		return err
@@ -172,95 +285,601 @@ func (db *DB) Update() error {
 		if err != nil {
 			return err
 		}
-		db.tree = tree
+		db.setTree(tree)
 	}
 	return nil
 }
 
 // Mkdir adds an empty subtree at key if it doesn't exist.
 func (db *DB) Mkdir(key string) error {
-	if db.parent != nil {
-		return db.parent.Mkdir(path.Join(db.scope, key))
+	p, err := db.fullPath(key)
+	if err != nil {
+		return err
 	}
 	empty, err := emptyTree(db.repo)
 	if err != nil {
 		return fmt.Errorf("emptyTree: %v", err)
 	}
-	newTree, err := TreeUpdate(db.repo, db.tree, path.Join(db.scope, key), empty)
+	root := db.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	newTree, err := TreeUpdate(db.repo, root.tree, p, empty)
 	if err != nil {
 		return fmt.Errorf("TreeUpdate: %v", err)
 	}
-	db.tree = newTree
+	root.setTree(newTree)
 	return nil
 }
 
 // Get returns the value of the Git blob at path `key`.
 // If there is no blob at the specified key, an error
-// is returned.
+// is returned: ErrNotExist if there is nothing at all, or ErrNotABlob
+// if the key holds a subtree.
 func (db *DB) Get(key string) (string, error) {
-	if db.tree == nil {
-		return "", os.ErrNotExist
-	}
-	e, err := db.tree.EntryByPath(path.Join(db.scope, key))
+	value, err := db.GetBytes(key)
 	if err != nil {
 		return "", err
 	}
+	return string(value), nil
+}
+
+// GetBytes is like Get, but returns the value as a byte slice.
+func (db *DB) GetBytes(key string) ([]byte, error) {
+	e, err := db.entry(key)
+	if err != nil {
+		return nil, err
+	}
+	if e.Type != git.ObjectBlob {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotABlob)
+	}
 	blob, err := db.lookupBlob(e.Id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer blob.Free()
-	return string(blob.Contents()), nil
+	return blob.Contents(), nil
+}
+
+// EntryInfo describes the value or subtree stored at a key.
+type EntryInfo struct {
+	// Type is git.ObjectBlob for a value, or git.ObjectTree for a
+	// subtree.
+	Type git.ObjectType
+	// Size is the size of a value in bytes, or 0 for a subtree.
+	Size int64
+	// Mode is the git filemode of the entry, for example 0100644 for
+	// a regular value, 0120000 for a symlink or 040000 for a subtree.
+	Mode int
+	// Hash is the id of the blob or tree.
+	Hash *git.Oid
+}
+
+// Exists returns true if there is a value or a subtree at `key`.
+// An error is only returned if the lookup itself fails.
+func (db *DB) Exists(key string) (bool, error) {
+	_, err := db.entry(key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Stat describes what is stored at `key`, without returning it.
+// Stat("/") describes the tree of db itself. The size of a value is read
+// from the object header when the object database supports it, so the
+// value is not loaded in memory.
+// If there is nothing at `key`, ErrNotExist is returned. As for Exists,
+// this includes the root, if nothing was stored yet.
+func (db *DB) Stat(key string) (*EntryInfo, error) {
+	e, err := db.entry(key)
+	if err != nil {
+		return nil, err
+	}
+	info := &EntryInfo{Type: e.Type, Mode: e.Filemode, Hash: e.Id}
+	if e.Type == git.ObjectBlob {
+		if info.Size, err = db.blobSize(e.Id); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// blobSize returns the size of the blob `id`. If the object database
+// supports it, only the object header is read. Otherwise the blob is
+// loaded.
+func (db *DB) blobSize(id *git.Oid) (int64, error) {
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return 0, err
+	}
+	defer odb.Free()
+	return db.odbBlobSize(odb, id)
+}
+
+// odbBlobSize is blobSize, with the object database `odb` of db.
+func (db *DB) odbBlobSize(odb *git.Odb, id *git.Oid) (int64, error) {
+	if size, _, err := odb.ReadHeader(id); err == nil {
+		return int64(size), nil
+	}
+	blob, err := db.lookupBlob(id)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Free()
+	return blob.Size(), nil
 }
 
 // Set writes the specified value in a Git blob, and updates the
 // uncommitted tree to point to that blob as `key`.
 func (db *DB) Set(key, value string) error {
-	if db.parent != nil {
-		return db.parent.Set(path.Join(db.scope, key), value)
-	}
-	var (
-		id  *git.Oid
-		err error
-	)
-	// FIXME: libgit2 crashes if value is empty.
-	// Work around this by shelling out to git.
-	if value == "" {
-		out, err := exec.Command("git", "--git-dir", db.repo.Path(), "hash-object", "-w", "--stdin").Output()
+	return db.setMode(key, value, 0100644)
+}
+
+// SetMany is like calling Set for each key and value of `values`, but
+// the tree is updated at once: each directory containing any of the
+// keys is written only once, instead of once per key. If a key is set
+// along with a key under it, for example "a" and "a/b", an error is
+// returned and nothing is set.
+func (db *DB) SetMany(values map[string]string) error {
+	root := &setNode{}
+	for key, value := range values {
+		p, err := db.fullPath(key)
 		if err != nil {
-			return fmt.Errorf("git hash-object: %v", err)
+			return err
+		}
+		if p == "/" {
+			return fmt.Errorf("%s: can't set a value at the root", key)
 		}
-		id, err = git.NewOid(strings.Trim(string(out), " \t\r\n"))
+		id, err := db.createBlob(value)
 		if err != nil {
-			return fmt.Errorf("git newoid %v", err)
+			return err
+		}
+		if err := root.add(strings.Split(p, "/"), id); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if len(root.children) == 0 {
+		return nil
+	}
+	r := db.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, err := root.write(db.repo, r.tree)
+	if err != nil {
+		return err
+	}
+	tree, err := lookupTree(db.repo, id)
+	if err != nil {
+		return err
+	}
+	r.setTree(tree)
+	return nil
+}
+
+// setNode is a directory, or a value if blob is set, in the tree of
+// keys passed to SetMany.
+type setNode struct {
+	blob     *git.Oid
+	children map[string]*setNode
+}
+
+// add adds the value `id` at the path `parts` under n.
+func (n *setNode) add(parts []string, id *git.Oid) error {
+	if n.blob != nil {
+		return fmt.Errorf("conflicts with a value set at a parent key")
+	}
+	if len(parts) == 0 {
+		if len(n.children) > 0 {
+			return fmt.Errorf("conflicts with values set under it")
 		}
+		n.blob = id
+		return nil
+	}
+	if n.children == nil {
+		n.children = make(map[string]*setNode)
+	}
+	child := n.children[parts[0]]
+	if child == nil {
+		child = &setNode{}
+		n.children[parts[0]] = child
+	}
+	return child.add(parts[1:], id)
+}
+
+// write writes the tree resulting from adding the contents of the
+// directory n to `tree`, which may be nil, and returns its id.
+func (n *setNode) write(repo *git.Repository, tree *git.Tree) (*git.Oid, error) {
+	var builder *git.TreeBuilder
+	var err error
+	if tree == nil {
+		builder, err = repo.TreeBuilder()
 	} else {
-		id, err = db.repo.CreateBlobFromBuffer([]byte(value))
+		builder, err = repo.TreeBuilderFromTree(tree)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+	for name, child := range n.children {
+		if child.blob != nil {
+			if err := builder.Insert(name, child.blob, 0100644); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Values in the way are replaced with directories, as in
+		// treeUpdate.
+		sub, err := subtree(repo, tree, name)
+		if err != nil {
+			return nil, err
+		}
+		id, err := child.write(repo, sub)
+		if sub != nil {
+			sub.Free()
+		}
 		if err != nil {
+			return nil, err
+		}
+		if err := builder.Insert(name, id, 040000); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Write()
+}
+
+// SetLink stores a symlink to `target` at `key`. As in git, the target
+// is the value of a blob with the symlink filemode.
+func (db *DB) SetLink(key, target string) error {
+	return db.setMode(key, target, 0120000)
+}
+
+// ReadLink returns the target of the symlink at `key`. If `key` holds
+// anything but a symlink, an error is returned.
+func (db *DB) ReadLink(key string) (string, error) {
+	e, err := db.entry(key)
+	if err != nil {
+		return "", err
+	}
+	if e.Filemode != 0120000 {
+		return "", fmt.Errorf("%s: not a symlink", key)
+	}
+	return db.Get(key)
+}
+
+// SetWithMode is like Set, but records the permissions `mode` on the
+// tree entry. Like git itself, only the executable bit is recorded: the
+// entry is 0755 if any executable bit is set in `mode`, and 0644
+// otherwise. Modes of other file types than regular files are rejected.
+func (db *DB) SetWithMode(key, value string, mode os.FileMode) error {
+	if !mode.IsRegular() {
+		return fmt.Errorf("%s: unsupported mode %v", key, mode)
+	}
+	return db.setMode(key, value, gitFileMode(mode))
+}
+
+// gitFileMode returns the git filemode of a regular file with the
+// permissions `perm`.
+func gitFileMode(perm os.FileMode) int {
+	if perm&0111 != 0 {
+		return 0100755
+	}
+	return 0100644
+}
+
+// setMode is like Set, but the blob is inserted in the tree with the
+// git filemode `mode` (for example 0120000 for a symlink).
+func (db *DB) setMode(key, value string, mode int) error {
+	id, err := db.createBlob(value)
+	if err != nil {
+		return err
+	}
+	return db.setId(key, id, mode)
+}
+
+// createBlob stores `value` in a new blob, without changing the tree.
+func (db *DB) createBlob(value string) (*git.Oid, error) {
+	if value == "" {
+		return db.createEmptyBlob()
+	}
+	return db.repo.CreateBlobFromBuffer([]byte(value))
+}
+
+// createEmptyBlob stores the empty blob, if it is not stored yet.
+// libgit2 crashes when creating a blob from an empty buffer, so it is
+// written through a stream instead, without writing any data.
+func (db *DB) createEmptyBlob() (*git.Oid, error) {
+	id, err := git.NewOid(emptyBlobId)
+	if err != nil {
+		return nil, err
+	}
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+	if odb.Exists(id) {
+		return id, nil
+	}
+	stream, err := odb.NewWriteStream(0, git.ObjectBlob)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Free()
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// setId updates the uncommitted tree to point to the existing object
+// `id` as `key`. If the object is a blob, it is inserted with the
+// git filemode `mode`.
+func (db *DB) setId(key string, id *git.Oid, mode int) error {
+	p, err := db.fullPath(key)
+	if err != nil {
+		return err
+	}
+	root := db.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	// note: root.tree might be nil if this is the first entry
+	newTree, err := treeUpdate(db.repo, root.tree, p, id, mode)
+	if err != nil {
+		return fmt.Errorf("treeupdate: %v", err)
+	}
+	root.setTree(newTree)
+	return nil
+}
+
+// Delete removes the value or subtree at `key` from the uncommitted
+// tree. Deleting a key which doesn't exist is not an error.
+func (db *DB) Delete(key string) error {
+	p, err := db.fullPath(key)
+	if err != nil {
+		return err
+	}
+	root := db.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.tree == nil {
+		return nil
+	}
+	newTree, err := TreeDelete(db.repo, root.tree, p)
+	if err != nil {
+		return fmt.Errorf("treedelete: %v", err)
+	}
+	root.setTree(newTree)
+	return nil
+}
+
+// Rename moves the value or subtree at `oldKey` to `newKey`, replacing
+// whatever was there, in a single update of the uncommitted tree. The
+// contents are not read: the existing object is inserted at `newKey`.
+// If there is nothing at `oldKey`, ErrNotExist is returned. Renaming
+// the root, or a key into its own subtree, returns ErrInvalidPath.
+func (db *DB) Rename(oldKey, newKey string) error {
+	src, err := db.fullPath(oldKey)
+	if err != nil {
+		return err
+	}
+	dst, err := db.fullPath(newKey)
+	if err != nil {
+		return err
+	}
+	if top, _ := db.fullPath("/"); src == top || dst == top {
+		return fmt.Errorf("rename %s to %s: %w", oldKey, newKey, ErrInvalidPath)
+	}
+	if dst != src && isUnder(dst, src) {
+		return fmt.Errorf("rename %s to %s: %w", oldKey, newKey, ErrInvalidPath)
+	}
+	return db.link(oldKey, src, dst, true)
+}
+
+// Copy inserts the value or subtree at `srcKey` at `dstKey` as well,
+// replacing whatever was there. Since git objects are immutable, the
+// contents are neither read nor duplicated. Copying the root into one
+// of its subtrees, for example "/" to "backup", takes a snapshot.
+// If there is nothing at `srcKey`, ErrNotExist is returned.
+func (db *DB) Copy(srcKey, dstKey string) error {
+	src, err := db.fullPath(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := db.fullPath(dstKey)
+	if err != nil {
+		return err
+	}
+	if top, _ := db.fullPath("/"); dst == top {
+		return fmt.Errorf("copy %s to %s: %w", srcKey, dstKey, ErrInvalidPath)
+	}
+	return db.link(srcKey, src, dst, false)
+}
+
+// link inserts the object at the tree path `src` at `dst`, and removes
+// it from `src` if `move` is true. `key` is the key of `src`, for error
+// messages.
+func (db *DB) link(key, src, dst string, move bool) error {
+	root := db.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.tree == nil {
+		return notExist(key)
+	}
+	var (
+		id   *git.Oid
+		mode int
+	)
+	if src == "/" {
+		id = root.tree.Id()
+	} else {
+		e, err := root.tree.EntryByPath(src)
+		if isNotFound(err) {
+			return notExist(key)
+		} else if err != nil {
 			return err
 		}
+		id, mode = e.Id, e.Filemode
 	}
-	// note: db.tree might be nil if this is the first entry
-	newTree, err := TreeUpdate(db.repo, db.tree, path.Join(db.scope, key), id)
+	if dst == src {
+		return nil
+	}
+	// Clear the destination first: a subtree inserted over another
+	// one would be merged with it.
+	cleared, err := TreeDelete(db.repo, root.tree, dst)
+	if err != nil {
+		return fmt.Errorf("treedelete: %v", err)
+	}
+	newTree, err := treeUpdate(db.repo, cleared, dst, id, mode)
+	cleared.Free()
 	if err != nil {
 		return fmt.Errorf("treeupdate: %v", err)
 	}
-	db.tree = newTree
+	// If the destination is a parent of the source, the source was
+	// replaced already.
+	if move && !isUnder(src, dst) {
+		moved, err := TreeDelete(db.repo, newTree, src)
+		newTree.Free()
+		if err != nil {
+			return fmt.Errorf("treedelete: %v", err)
+		}
+		newTree = moved
+	}
+	root.setTree(newTree)
 	return nil
 }
 
+// isUnder returns true if the tree path `p` is `dir` or is inside it.
+func isUnder(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
 // SetStream writes the data from `src` to a new Git blob,
 // and updates the uncommitted tree to point to that blob as `key`.
 func (db *DB) SetStream(key string, src io.Reader) error {
-	// FIXME: instead of buffering the entire value, use
-	// libgit2 CreateBlobFromChunks to stream the data straight
-	// into git.
-	buf := new(bytes.Buffer)
-	_, err := io.Copy(buf, src)
+	return db.setStreamMode(key, src, 0100644)
+}
+
+// setStreamMode is like SetStream, but the blob is inserted in the tree
+// with the git filemode `mode`.
+func (db *DB) setStreamMode(key string, src io.Reader, mode int) error {
+	id, err := db.createBlobStream(src)
 	if err != nil {
 		return err
 	}
-	return db.Set(key, buf.String())
+	return db.setId(key, id, mode)
+}
+
+// createBlobStream stores the data from `src` in a new blob, without
+// changing the tree.
+func (db *DB) createBlobStream(src io.Reader) (*git.Oid, error) {
+	// Empty values go through createEmptyBlob.
+	r := bufio.NewReader(src)
+	if _, err := r.Peek(1); err == io.EOF {
+		return db.createBlob("")
+	} else if err != nil {
+		return nil, err
+	}
+	// libgit2 pulls the data in chunks of at most maxLen bytes, so
+	// the value is never buffered in its entirety.
+	var (
+		buf     []byte
+		readErr error
+	)
+	return db.repo.CreateBlobFromChunks("", func(maxLen int) ([]byte, error) {
+		if readErr != nil {
+			return nil, readErr
+		}
+		if len(buf) < maxLen {
+			buf = make([]byte, maxLen)
+		}
+		for {
+			n, err := r.Read(buf[:maxLen])
+			if n > 0 {
+				// Report the error on the next call
+				readErr = err
+				return buf[:n], nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	})
+}
+
+// scopedPath returns the path of `key` relative to `scope`, as accepted
+// by TreePath. Keys are always relative to the scope: a leading "/" is
+// ignored, and ErrInvalidPath is returned if ".." components would
+// escape the scope, or if a component is not a valid name (see
+// EscapeKey).
+func scopedPath(scope, key string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(key, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s: %w", key, ErrInvalidPath)
+	}
+	p := TreePath(path.Join(scope, clean))
+	if p == "/" {
+		return p, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if !validName(name) {
+			return "", fmt.Errorf("%q: %w", key, ErrInvalidPath)
+		}
+	}
+	return p, nil
+}
+
+// fullPath returns the path of `key` in the tree of the root database,
+// applying the scope of db and of each database it was scoped from.
+func (db *DB) fullPath(key string) (string, error) {
+	for ; db != nil; db = db.parent {
+		var err error
+		if key, err = scopedPath(db.scope, key); err != nil {
+			return "", err
+		}
+	}
+	return key, nil
+}
+
+// entry returns the entry of the current tree at `key`, relative to
+// the scope of db. The root of the tree is described by an entry
+// without a name.
+// If there is no such entry, ErrNotExist is returned. This includes the
+// root, if nothing was stored yet.
+func (db *DB) entry(key string) (*git.TreeEntry, error) {
+	p, err := db.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	root := db.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	if root.tree == nil {
+		return nil, notExist(key)
+	}
+	if p == "/" {
+		// libgit2 doesn't look up the tree itself by path
+		return &git.TreeEntry{Id: root.tree.Id(), Type: git.ObjectTree, Filemode: 040000}, nil
+	}
+	e, err := root.tree.EntryByPath(p)
+	if isNotFound(err) {
+		return nil, notExist(key)
+	}
+	return e, err
+}
+
+// currentSubtree returns the subtree of the current tree at `p`, a path
+// returned by fullPath, or nil if there is no current tree.
+// The result is a new object, which the caller must free.
+func (db *DB) currentSubtree(p string) (*git.Tree, error) {
+	root := db.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	if root.tree == nil {
+		return nil, nil
+	}
+	return lookupSubtree(db.repo, root.tree, p)
 }
 
 func TreePath(p string) string {
@@ -275,15 +894,21 @@ func TreePath(p string) string {
 }
 
 // List returns a list of object names at the subtree `key`.
-// If there is no subtree at `key`, an error is returned.
+// If there is no subtree at `key`, an error is returned: ErrNotExist
+// if there is nothing at all, or ErrNotADirectory if the key holds a
+// blob.
 func (db *DB) List(key string) ([]string, error) {
-	if db.tree == nil {
-		return []string{}, nil
+	p, err := db.fullPath(key)
+	if err != nil {
+		return nil, err
 	}
-	subtree, err := lookupSubtree(db.repo, db.tree, path.Join(db.scope, key))
+	subtree, err := db.currentSubtree(p)
 	if err != nil {
 		return nil, err
 	}
+	if subtree == nil {
+		return []string{}, nil
+	}
 	defer subtree.Free()
 	var (
 		i     uint64
@@ -296,6 +921,108 @@ func (db *DB) List(key string) ([]string, error) {
 	return entries, nil
 }
 
+// ListRecursive returns the paths of all values under the subtree `key`,
+// relative to it. Subtrees are not listed themselves. Since git sorts
+// tree entries as if subtree names ended with a slash, the paths are in
+// lexicographic order.
+// If there is no subtree at `key`, an error is returned, as with List.
+func (db *DB) ListRecursive(key string) ([]string, error) {
+	p, err := db.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	subtree, err := db.currentSubtree(p)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	if subtree == nil {
+		return keys, nil
+	}
+	defer subtree.Free()
+	// Only tree entries are needed: no object is looked up.
+	err = subtree.Walk(func(parent string, e *git.TreeEntry) int {
+		if e.Type == git.ObjectBlob {
+			keys = append(keys, path.Join(parent, e.Name))
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Count returns the number of values under the subtree `key`, at any
+// depth. Only trees are read.
+// If there is no subtree at `key`, an error is returned, as with List.
+func (db *DB) Count(key string) (int, error) {
+	p, err := db.fullPath(key)
+	if err != nil {
+		return 0, err
+	}
+	subtree, err := db.currentSubtree(p)
+	if err != nil || subtree == nil {
+		return 0, err
+	}
+	defer subtree.Free()
+	var n int
+	err = subtree.Walk(func(parent string, e *git.TreeEntry) int {
+		if e.Type == git.ObjectBlob {
+			n++
+		}
+		return 0
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// TotalSize returns the sum of the sizes of the values under the
+// subtree `key`, at any depth. A value stored at several keys is
+// counted once for each key. Sizes are read from the object headers
+// when the object database supports it, so values are not loaded in
+// memory.
+// If there is no subtree at `key`, an error is returned, as with List.
+func (db *DB) TotalSize(key string) (int64, error) {
+	p, err := db.fullPath(key)
+	if err != nil {
+		return 0, err
+	}
+	subtree, err := db.currentSubtree(p)
+	if err != nil || subtree == nil {
+		return 0, err
+	}
+	defer subtree.Free()
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return 0, err
+	}
+	defer odb.Free()
+	var total int64
+	var sizeErr error
+	err = subtree.Walk(func(parent string, e *git.TreeEntry) int {
+		if e.Type != git.ObjectBlob {
+			return 0
+		}
+		size, err := db.odbBlobSize(odb, e.Id)
+		if err != nil {
+			sizeErr = fmt.Errorf("%s: %v", path.Join(parent, e.Name), err)
+			return -1
+		}
+		total += size
+		return 0
+	})
+	if sizeErr != nil {
+		return 0, sizeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
 // Commit atomically stores all database changes since the last commit
 // into a new Git commit object, and updates the database's reference
 // to point to that commit.
@@ -303,28 +1030,44 @@ func (db *DB) Commit(msg string) error {
 	if db.parent != nil {
 		return db.parent.Commit(msg)
 	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if db.tree == nil {
 		return fmt.Errorf("nothing to commit")
 	}
-	// FIXME: the ref might have been changed by another
-	// process. We must implement either 1) reliable locking
-	// or 2) a solid merge resolution strategy.
-	// For now we simply assume the ref has not changed.
+	// The reference may have moved since db was updated: by a Pull
+	// which failed to merge, or by another process.
+	tip, err := db.repo.LookupReference(db.ref)
+	if err == nil {
+		target := tip.Target().String()
+		moved := db.commit == nil || db.commit.Id().String() != target
+		tip.Free()
+		if moved {
+			return fmt.Errorf("%s moved to %s: %w", db.ref, target, ErrConflict)
+		}
+	} else if !IsNoRef(err) {
+		return fmt.Errorf("%s: %v", db.ref, err)
+	}
 	var parents []*git.Commit
 	if db.commit != nil {
 		commitTree, err := db.commit.Tree()
 		if err != nil {
 			return err
 		}
+		defer commitTree.Free()
 		if commitTree.Id().Equal(db.tree.Id()) {
 			return fmt.Errorf("nothing to commit")
 		}
 		parents = append(parents, db.commit)
 	}
+	now := time.Now
+	if db.clock != nil {
+		now = db.clock
+	}
 	commitId, err := db.repo.CreateCommit(
 		db.ref,
-		&git.Signature{"libpack", "libpack", time.Now()}, // author
-		&git.Signature{"libpack", "libpack", time.Now()}, // committer
+		&git.Signature{"libpack", "libpack", now()}, // author
+		&git.Signature{"libpack", "libpack", now()}, // committer
 		msg,
 		db.tree,    // git tree to commit
 		parents..., // parent commit (0 or 1)
@@ -343,39 +1086,138 @@ func (db *DB) Commit(msg string) error {
 	return nil
 }
 
-func (db *DB) Checkout(dir string) error {
-	if db.tree == nil {
-		return fmt.Errorf("no tree")
+// uncommitted returns true if the current tree of the root database db
+// has changes which were not committed yet. The caller must hold the
+// lock of db.
+func (db *DB) uncommitted() (bool, error) {
+	if db.commit == nil {
+		return db.tree != nil, nil
 	}
-	/*
-		tree, err := lookupSubtree(db.repo, db.tree, db.scope)
-		if err != nil {
-			return err
+	commitTree, err := db.commit.Tree()
+	if err != nil {
+		return false, err
+	}
+	defer commitTree.Free()
+	return !commitTree.Id().Equal(db.tree.Id()), nil
+}
+
+// SetClock sets the function which Commit calls to timestamp commits of
+// db and of the databases scoped from it. A nil clock restores the
+// default, time.Now.
+func (db *DB) SetClock(clock func() time.Time) {
+	if db.parent != nil {
+		db.parent.SetClock(clock)
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.clock = clock
+}
+
+// DeterministicCommits is a clock which always returns the Unix epoch.
+// With db.SetClock(DeterministicCommits), committing the same tree with
+// the same parent and message always yields the same commit hash.
+func DeterministicCommits() time.Time {
+	return time.Unix(0, 0).UTC()
+}
+
+// LogEntry describes a commit in the history of a database.
+type LogEntry struct {
+	Id      *git.Oid
+	Time    time.Time
+	Message string
+}
+
+// Log returns the history of the database's reference, from the latest
+// commit back, following first parents. At most `n` entries are
+// returned, or all of them if `n` is not positive.
+// Uncommitted changes are not part of the history.
+func (db *DB) Log(n int) ([]LogEntry, error) {
+	var entries []LogEntry
+	root := db.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	head := root.commit
+	commit := head
+	for commit != nil && (n <= 0 || len(entries) < n) {
+		entries = append(entries, LogEntry{
+			Id:      commit.Id(),
+			Time:    commit.Committer().When,
+			Message: commit.Message(),
+		})
+		var parent *git.Commit
+		if commit.ParentCount() > 0 {
+			if parent = commit.Parent(0); parent == nil {
+				return nil, fmt.Errorf("%v: cannot load parent %v", commit.Id(), commit.ParentId(0))
+			}
+		}
+		if commit != head {
+			commit.Free()
 		}
-	*/
-	// ^-- We should scope checkout to db.scope.
-	// v-- But for now, we checkout the whole root to facilitat debug
-	tree := db.tree
+		commit = parent
+	}
+	if commit != nil && commit != head {
+		commit.Free()
+	}
+	return entries, nil
+}
+
+// Checkout writes the files of the current tree of db, within its scope,
+// to the directory `dir`, which is created if needed. If `dir` is empty,
+// a new temporary directory is created. The directory is returned.
+// Uncommitted changes are included. The repository's index is not
+// modified.
+func (db *DB) Checkout(dir string) (string, error) {
+	p, err := db.fullPath("/")
+	if err != nil {
+		return "", err
+	}
+	tree, err := db.currentSubtree(p)
+	if err != nil {
+		return "", err
+	}
+	if tree == nil {
+		return "", fmt.Errorf("no tree")
+	}
+	defer tree.Free()
+	if dir == "" {
+		if dir, err = ioutil.TempDir("", "libpack-checkout-"); err != nil {
+			return "", err
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
 	// If the tree is empty, checkout will fail and there is
 	// nothing to do anyway
 	if tree.EntryCount() == 0 {
-		return nil
+		return dir, nil
+	}
+	// Check out through a temporary index, so that the index of the
+	// repository is left alone.
+	index, err := ioutil.TempFile("", "libpack-index-")
+	if err != nil {
+		return "", err
 	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
 	stderr := new(bytes.Buffer)
 	args := []string{
 		"--git-dir", db.repo.Path(), "--work-tree", dir,
-		"checkout", tree.Id().String(), ".",
+		"checkout", tree.Id().String(), "--", ".",
 	}
 	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+index.Name())
 	cmd.Stderr = stderr
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%s", stderr.String())
+		return "", fmt.Errorf("git checkout: %s", strings.TrimSpace(stderr.String()))
 	}
-	return nil
+	return dir, nil
 }
 
 // lookupBlob looks up an object at hash `id` in `repo`, and returns
 // it as a git blob. If the object is not a blob, an error is returned.
+// The caller must free the blob.
 func (db *DB) lookupBlob(id *git.Oid) (*git.Blob, error) {
 	obj, err := db.repo.Lookup(id)
 	if err != nil {
@@ -384,11 +1226,13 @@ func (db *DB) lookupBlob(id *git.Oid) (*git.Blob, error) {
 	if blob, ok := obj.(*git.Blob); ok {
 		return blob, nil
 	}
-	return nil, fmt.Errorf("hash %v exist but is not a blob", id)
+	obj.Free()
+	return nil, fmt.Errorf("hash %v: %w", id, ErrNotABlob)
 }
 
 // lookupTree looks up an object at hash `id` in `repo`, and returns
 // it as a git tree. If the object is not a tree, an error is returned.
+// The caller must free the tree.
 func (db *DB) lookupTree(id *git.Oid) (*git.Tree, error) {
 	return lookupTree(db.repo, id)
 }
@@ -401,11 +1245,13 @@ func lookupTree(r *git.Repository, id *git.Oid) (*git.Tree, error) {
 	if tree, ok := obj.(*git.Tree); ok {
 		return tree, nil
 	}
-	return nil, fmt.Errorf("hash %v exist but is not a tree", id)
+	obj.Free()
+	return nil, fmt.Errorf("hash %v: %w", id, ErrNotADirectory)
 }
 
 // lookupCommit looks up an object at hash `id` in `repo`, and returns
 // it as a git commit. If the object is not a commit, an error is returned.
+// The caller must free the commit.
 func (db *DB) lookupCommit(id *git.Oid) (*git.Commit, error) {
 	obj, err := db.repo.Lookup(id)
 	if err != nil {
@@ -414,9 +1260,13 @@ func (db *DB) lookupCommit(id *git.Oid) (*git.Commit, error) {
 	if commit, ok := obj.(*git.Commit); ok {
 		return commit, nil
 	}
+	obj.Free()
 	return nil, fmt.Errorf("hash %v exist but is not a commit", id)
 }
 
+// lookupSubtree returns the subtree of `tree` at path `name`, or `tree`
+// itself if name is "/". The result is always a new object, which the
+// caller must free.
 func lookupSubtree(repo *git.Repository, tree *git.Tree, name string) (*git.Tree, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("tree undefined")
@@ -428,9 +1278,14 @@ func lookupSubtree(repo *git.Repository, tree *git.Tree, name string) (*git.Tree
 		return lookupTree(repo, tree.Id())
 	}
 	entry, err := tree.EntryByPath(name)
-	if err != nil {
+	if isNotFound(err) {
+		return nil, notExist(name)
+	} else if err != nil {
 		return nil, err
 	}
+	if entry.Type != git.ObjectTree {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotADirectory)
+	}
 	return lookupTree(repo, entry.Id)
 }
 
@@ -441,5 +1296,6 @@ func emptyTree(repo *git.Repository) (*git.Oid, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer builder.Free()
 	return builder.Write()
 }
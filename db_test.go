@@ -1,12 +1,19 @@
 package libpack
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+
+	git "github.com/libgit2/git2go"
 )
 
 func tmpdir(t *testing.T) string {
@@ -56,9 +63,24 @@ func TestSetEmpty(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db.Free()
+	// The empty blob is created without running git
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
 	if err := db.Set("foo", ""); err != nil {
 		t.Fatal(err)
 	}
+	if err := db.Set("bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("foo"); err != nil || val != "" {
+		t.Fatalf("foo = %q, %v", val, err)
+	}
+	if info, err := db.Stat("foo"); err != nil {
+		t.Fatal(err)
+	} else if info.Hash.String() != emptyBlobId || info.Size != 0 {
+		t.Fatalf("%#v", info)
+	}
 }
 
 func TestList(t *testing.T) {
@@ -91,10 +113,19 @@ func TestList(t *testing.T) {
 		if err == nil {
 			t.Fatalf("should fail: %s", wrongpath)
 		}
-		if !strings.Contains(err.Error(), "does not exist in the given tree") {
+		if !errors.Is(err, ErrNotExist) {
 			t.Fatalf("wrong error: %v", err)
 		}
 	}
+	if _, err := db.List("foo"); !errors.Is(err, ErrNotADirectory) {
+		t.Fatalf("listing a blob: expected ErrNotADirectory, got %v", err)
+	}
+	if err := db.Set("dir/bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("dir"); !errors.Is(err, ErrNotABlob) {
+		t.Fatalf("getting a subtree: expected ErrNotABlob, got %v", err)
+	}
 }
 
 func TestSetGetSimple(t *testing.T) {
@@ -278,3 +309,902 @@ func TestMkdir(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// zeroReader is an io.Reader producing an endless stream of zeroes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestSetStreamLarge(t *testing.T) {
+	const size = 64 << 20
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := db.SetStream("big", io.LimitReader(zeroReader{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Fatalf("streaming %d bytes allocated %d bytes", size, allocated)
+	}
+	e, err := db.tree.EntryByPath("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := db.lookupBlob(e.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Free()
+	if blob.Size() != size {
+		t.Fatalf("expected %d bytes, got %d", size, blob.Size())
+	}
+}
+
+func TestSetStreamEmpty(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetStream("foo", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("foo"); err != nil {
+		t.Fatal(err)
+	} else if val != "" {
+		t.Fatalf("%#v", val)
+	}
+}
+
+func TestLog(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if entries, err := db.Log(0); err != nil || len(entries) != 0 {
+		t.Fatalf("empty database: %v, %v", entries, err)
+	}
+	for _, val := range []string{"a", "b", "c"} {
+		if err := db.Set("foo", val); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Commit("set foo=" + val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := db.Log(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, e := range entries {
+		messages = append(messages, e.Message)
+	}
+	if fmt.Sprintf("%v", messages) != "[set foo=c set foo=b set foo=a]" {
+		t.Fatalf("%v", messages)
+	}
+	if !entries[0].Id.Equal(db.Head()) {
+		t.Fatalf("first entry is %v, expected the head %v", entries[0].Id, db.Head())
+	}
+	if entries, err := db.Log(2); err != nil || len(entries) != 2 {
+		t.Fatalf("Log(2): %v, %v", entries, err)
+	}
+}
+
+// rss returns the resident set size of the current process, in bytes.
+func rss(t *testing.T) int64 {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skipf("cannot measure memory usage: %v", err)
+	}
+	var size, resident int64
+	if _, err := fmt.Sscan(string(statm), &size, &resident); err != nil {
+		t.Fatal(err)
+	}
+	return resident * int64(os.Getpagesize())
+}
+
+func TestSetGetLeak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping leak test in short mode")
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	scoped := db.Scope("scoped")
+	cycle := func(i int) {
+		key := fmt.Sprintf("a/b/%d", i%100)
+		val := fmt.Sprintf("%d", i)
+		for _, d := range []*DB{db, scoped} {
+			if err := d.Set(key, val); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := d.Get(key); err != nil || v != val {
+				t.Fatalf("%s = %q, %v", key, v, err)
+			}
+		}
+		if i%1000 == 0 {
+			if err := db.Commit(val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Warm up caches before measuring
+	for i := 0; i < 1000; i++ {
+		cycle(i)
+	}
+	runtime.GC()
+	before := rss(t)
+	for i := 0; i < 10000; i++ {
+		cycle(i)
+	}
+	runtime.GC()
+	if growth := rss(t) - before; growth > 32<<20 {
+		t.Fatalf("10000 set/get cycles grew RSS by %d bytes", growth)
+	}
+}
+
+func TestScopeEscape(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.Set("secret", "root"); err != nil {
+		t.Fatal(err)
+	}
+	nested := db.Scope("nested")
+	for _, key := range []string{
+		"..", "../secret", "a/../../secret", "/../secret", "a/../../../scope/secret",
+		// Names git refuses
+		".git", "a/.GIT/b", "a\x00b",
+	} {
+		for name, d := range map[string]*DB{"db": db, "nested": nested} {
+			if err := d.Set(key, "escaped"); !errors.Is(err, ErrInvalidPath) {
+				t.Fatalf("%s.Set(%q): expected ErrInvalidPath, got %v", name, key, err)
+			}
+			if _, err := d.Get(key); !errors.Is(err, ErrInvalidPath) {
+				t.Fatalf("%s.Get(%q): expected ErrInvalidPath, got %v", name, key, err)
+			}
+			if _, err := d.List(key); !errors.Is(err, ErrInvalidPath) {
+				t.Fatalf("%s.List(%q): expected ErrInvalidPath, got %v", name, key, err)
+			}
+			if err := d.Delete(key); !errors.Is(err, ErrInvalidPath) {
+				t.Fatalf("%s.Delete(%q): expected ErrInvalidPath, got %v", name, key, err)
+			}
+			if err := d.Walk(key, func(string, git.Object) error { return nil }); !errors.Is(err, ErrInvalidPath) {
+				t.Fatalf("%s.Walk(%q): expected ErrInvalidPath, got %v", name, key, err)
+			}
+		}
+	}
+	// Crafted scopes can't escape either
+	for _, scope := range []string{"..", "../scope", "a/../..", ".git"} {
+		if err := db.Scope(scope).Set("secret", "escaped"); !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("Scope(%q).Set: expected ErrInvalidPath, got %v", scope, err)
+		}
+	}
+	// Absolute keys and ".." within the scope stay in the scope
+	if err := nested.Set("/a/../abs", "nested"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("nested/abs"); err != nil || val != "nested" {
+		t.Fatalf("nested/abs = %q, %v", val, err)
+	}
+	if val, err := db.Get("secret"); err != nil || val != "root" {
+		t.Fatalf("secret = %q, %v", val, err)
+	}
+	if err := db.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := ResolveTree(db.Repo(), "refs/heads/test", "scope/nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Free()
+	if _, err := tree.EntryByPath("abs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveTree(db.Repo(), "refs/heads/test", "scope/../.."); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("ResolveTree: expected ErrInvalidPath, got %v", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for _, key := range []string{"a/b/c", "a/d", "e"} {
+		if err := db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk := func(d *DB, key string) string {
+		var keys []string
+		err := d.Walk(key, func(k string, obj git.Object) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		return strings.Join(keys, " ")
+	}
+	for _, key := range []string{"", "/", ".", "//"} {
+		if keys := walk(db, key); keys != "a a/b a/b/c a/d e" {
+			t.Fatalf("Walk(%q): %s", key, keys)
+		}
+	}
+	for _, key := range []string{"a", "/a", "a/", "./a/b/.."} {
+		if keys := walk(db, key); keys != "b b/c d" {
+			t.Fatalf("Walk(%q): %s", key, keys)
+		}
+	}
+	if keys := walk(db.Scope("a"), "/"); keys != "b b/c d" {
+		t.Fatalf("scoped Walk: %s", keys)
+	}
+	if keys := walk(db.Scope("/a/").Scope("b"), ""); keys != "c" {
+		t.Fatalf("nested scoped Walk: %s", keys)
+	}
+}
+
+func TestWalkEmpty(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	err = db.Walk("/", func(k string, obj git.Object) error {
+		t.Fatalf("empty database: unexpected key %s", k)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Walk("a", func(string, git.Object) error { return nil }); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("a: expected ErrNotExist, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil || buf.String() != "" {
+		t.Fatalf("Dump: %q, %v", buf.String(), err)
+	}
+	if err := db.DumpJSON(&buf); err != nil || buf.String() != "{}\n" {
+		t.Fatalf("DumpJSON: %q, %v", buf.String(), err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	const (
+		dbs     = 3
+		writers = 4
+		n       = 200
+	)
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, dbs*(writers+2))
+	)
+	for i := 0; i < dbs; i++ {
+		db, err := Init(tmp, fmt.Sprintf("refs/heads/test%d", i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Free()
+		if err := db.Set("init", "init"); err != nil {
+			t.Fatal(err)
+		}
+		// Writers set and read back their own keys, half of them
+		// through a scoped database.
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(d *DB, w int) {
+				defer wg.Done()
+				if w%2 == 1 {
+					d = d.Scope(fmt.Sprintf("scope%d", w))
+				}
+				for j := 0; j < n; j++ {
+					key := fmt.Sprintf("w%d/%d", w, j%10)
+					val := fmt.Sprintf("%d", j)
+					if err := d.Set(key, val); err != nil {
+						errs <- err
+						return
+					}
+					if v, err := d.Get(key); err != nil || v != val {
+						errs <- fmt.Errorf("%s = %q, %v", key, v, err)
+						return
+					}
+				}
+			}(db, w)
+		}
+		// The committer is the only one to commit, and always has a
+		// change of its own to commit.
+		wg.Add(1)
+		go func(d *DB) {
+			defer wg.Done()
+			for j := 0; j < n/10; j++ {
+				if err := d.Set("commits", fmt.Sprintf("%d", j)); err != nil {
+					errs <- err
+					return
+				}
+				if err := d.Commit(fmt.Sprintf("commit %d", j)); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := d.Log(0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(db)
+		wg.Add(1)
+		go func(d *DB) {
+			defer wg.Done()
+			for j := 0; j < n/10; j++ {
+				err := d.Walk("/", func(key string, obj git.Object) error {
+					if blob, isBlob := obj.(*git.Blob); isBlob {
+						blob.Contents()
+					}
+					return nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := d.List("/"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(db)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(path.Join(tmp, "repo"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for key, val := range map[string]string{"foo/bar/baz": "nested", "top": "level"} {
+		if err := db.Set(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertFile := func(p, val string) {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != val {
+			t.Fatalf("%s: expected %q, got %q", p, val, data)
+		}
+	}
+	// A temporary directory is created
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	assertFile(path.Join(dir, "foo/bar/baz"), "nested")
+	assertFile(path.Join(dir, "top"), "level")
+	// The directory is created, and only the scope is checked out
+	dst := path.Join(tmp, "a/b")
+	if dir, err := db.Scope("foo").Checkout(dst); err != nil {
+		t.Fatal(err)
+	} else if dir != dst {
+		t.Fatalf("checked out in %s, expected %s", dir, dst)
+	}
+	assertFile(path.Join(dst, "bar/baz"), "nested")
+	if _, err := os.Stat(path.Join(dst, "top")); !os.IsNotExist(err) {
+		t.Fatalf("top was checked out outside of the scope: %v", err)
+	}
+	if _, err := os.Stat(path.Join(db.Repo().Path(), "index")); !os.IsNotExist(err) {
+		t.Fatalf("checkout created an index in the repository: %v", err)
+	}
+}
+
+func TestGetBytesStat(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	binary := "\x00\xff\xfe binary \x00"
+	if err := db.Set("dir/bin", binary); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.GetBytes("dir/bin"); err != nil {
+		t.Fatal(err)
+	} else if string(value) != binary {
+		t.Fatalf("%q", value)
+	}
+	if info, err := db.Stat("dir/bin"); err != nil {
+		t.Fatal(err)
+	} else if info.Type != git.ObjectBlob || info.Size != int64(len(binary)) || info.Mode != 0100644 {
+		t.Fatalf("dir/bin: %#v", info)
+	}
+	if err := db.SetLink("dir/link", "bin"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := db.Stat("dir/link"); err != nil {
+		t.Fatal(err)
+	} else if info.Size != 3 || info.Mode != 0120000 {
+		t.Fatalf("dir/link: %#v", info)
+	}
+	if info, err := db.Stat("dir"); err != nil {
+		t.Fatal(err)
+	} else if info.Type != git.ObjectTree || info.Size != 0 || info.Mode != 040000 {
+		t.Fatalf("dir: %#v", info)
+	}
+	scoped := db.Scope("dir")
+	if info, err := scoped.Stat("/"); err != nil {
+		t.Fatal(err)
+	} else if dir, err := db.Stat("dir"); err != nil {
+		t.Fatal(err)
+	} else if info.Type != git.ObjectTree || info.Hash.String() != dir.Hash.String() {
+		t.Fatalf("/ of dir: %#v, expected %#v", info, dir)
+	}
+	if info, err := db.Stat("/"); err != nil {
+		t.Fatal(err)
+	} else if info.Type != git.ObjectTree || !info.Hash.Equal(db.tree.Id()) {
+		t.Fatalf("/: %#v", info)
+	}
+	if _, err := db.Stat("missing"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("missing: expected ErrNotExist, got %v", err)
+	}
+	if _, err := db.GetBytes("dir"); !errors.Is(err, ErrNotABlob) {
+		t.Fatalf("dir: expected ErrNotABlob, got %v", err)
+	}
+}
+
+func TestExists(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for _, key := range []string{"foo", "/"} {
+		if exists, err := db.Exists(key); err != nil || exists {
+			t.Fatalf("empty database: %s: %v, %v", key, exists, err)
+		}
+		if _, err := db.Stat(key); !errors.Is(err, ErrNotExist) {
+			t.Fatalf("empty database: %s: expected ErrNotExist, got %v", key, err)
+		}
+	}
+	if err := db.Set("foo/bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{
+		"/":           true,
+		"":            true,
+		"foo":         true,
+		"foo/bar":     true,
+		"missing":     false,
+		"foo/missing": false,
+		"foo/bar/baz": false,
+	} {
+		if exists, err := db.Exists(key); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		} else if exists != expected {
+			t.Fatalf("%s: expected %v, got %v", key, expected, exists)
+		}
+	}
+	// Absence is reported consistently, and distinguishable from
+	// other failures
+	if _, err := db.Get("missing"); !os.IsNotExist(err) {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, err := db.List("missing"); !os.IsNotExist(err) {
+		t.Fatalf("List: %v", err)
+	}
+	if _, err := db.Get("/"); !errors.Is(err, ErrNotABlob) {
+		t.Fatalf("Get(\"/\"): expected ErrNotABlob, got %v", err)
+	}
+	if _, err := db.Exists("../escape"); err == nil || os.IsNotExist(err) {
+		t.Fatalf("Exists(\"../escape\"): %v", err)
+	}
+}
+
+func TestListRecursive(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	// Names sorting differently as paths and as tree entries
+	for _, key := range []string{"a0", "a/x", "a.txt", "a-b/c", "b/c/d", "b/c/e"} {
+		if err := db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Mkdir("empty"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.ListRecursive("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", keys) != "[a-b/c a.txt a/x a0 b/c/d b/c/e]" {
+		t.Fatalf("%v", keys)
+	}
+	if keys, err := db.ListRecursive("b"); err != nil || fmt.Sprintf("%v", keys) != "[c/d c/e]" {
+		t.Fatalf("b: %v, %v", keys, err)
+	}
+	if keys, err := db.Scope("b").ListRecursive("c"); err != nil || fmt.Sprintf("%v", keys) != "[d e]" {
+		t.Fatalf("scoped: %v, %v", keys, err)
+	}
+	if _, err := db.ListRecursive("missing"); !os.IsNotExist(err) {
+		t.Fatalf("missing: %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for _, key := range []string{"a/x", "a/y", "b/z", "c", "d/e/f"} {
+		if err := db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.setMode("exec", "#!/bin/sh", 0100755); err != nil {
+		t.Fatal(err)
+	}
+	dump := func() string {
+		var buf bytes.Buffer
+		if err := db.Dump(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	// A subtree replaces the destination instead of being merged
+	if err := db.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	// A value moves to a new directory
+	if err := db.Rename("c", "new/c"); err != nil {
+		t.Fatal(err)
+	}
+	// A subtree replaces its own parent
+	if err := db.Rename("d/e", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Rename("exec", "exec2"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"b/\n" +
+		"b/x = a/x\n" +
+		"b/y = a/y\n" +
+		"d/\n" +
+		"d/f = d/e/f\n" +
+		"exec2 = #!/bin/sh\n" +
+		"new/\n" +
+		"new/c = c\n"
+	if d := dump(); d != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, d)
+	}
+	if e, err := db.entry("exec2"); err != nil || e.Filemode != 0100755 {
+		t.Fatalf("exec2: %v, %v", e, err)
+	}
+	if err := db.Rename("missing", "x"); !os.IsNotExist(err) {
+		t.Fatalf("missing: %v", err)
+	}
+	for _, keys := range [][2]string{{"b", "b/x/y"}, {"/", "x"}, {"b", "/"}} {
+		if err := db.Rename(keys[0], keys[1]); !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("%s to %s: expected ErrInvalidPath, got %v", keys[0], keys[1], err)
+		}
+	}
+	if d := dump(); d != expected {
+		t.Fatalf("failed renames changed the tree:\n%s", d)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for _, key := range []string{"a/x", "b/y", "c"} {
+		if err := db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Copy("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Copy("c", "d/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Copy("/", "backup"); err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot is not affected by later changes
+	if err := db.Set("a/x", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"a/\n" +
+		"a/x = changed\n" +
+		"b/\n" +
+		"b/x = a/x\n" +
+		"backup/\n" +
+		"backup/a/\n" +
+		"backup/a/x = a/x\n" +
+		"backup/b/\n" +
+		"backup/b/x = a/x\n" +
+		"backup/c = c\n" +
+		"backup/d/\n" +
+		"backup/d/c = c\n" +
+		"c = c\n" +
+		"d/\n" +
+		"d/c = c\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if err := db.Copy("missing", "x"); !os.IsNotExist(err) {
+		t.Fatalf("missing: %v", err)
+	}
+	if err := db.Copy("a", "/"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("copy to the root: %v", err)
+	}
+}
+
+func TestSetWithMode(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for _, test := range []struct {
+		key      string
+		mode     os.FileMode
+		expected int
+	}{
+		{"script", 0755, 0100755},
+		{"user-exec", 0700, 0100755},
+		{"other-exec", 0601, 0100755},
+		{"plain", 0644, 0100644},
+		{"private", 0600, 0100644},
+	} {
+		if err := db.SetWithMode(test.key, "value", test.mode); err != nil {
+			t.Fatal(err)
+		}
+		e, err := db.entry(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Filemode != test.expected {
+			t.Fatalf("%s: expected %o, got %o", test.key, test.expected, e.Filemode)
+		}
+	}
+	if err := db.Set("default", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := db.entry("default"); err != nil || e.Filemode != 0100644 {
+		t.Fatalf("default: %v, %v", e, err)
+	}
+	for _, mode := range []os.FileMode{os.ModeDir | 0755, os.ModeSymlink | 0777} {
+		if err := db.SetWithMode("bad", "value", mode); err == nil {
+			t.Fatalf("mode %v should be rejected", mode)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(path.Join(tmp, "repo"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.Set("dir/file", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetLink("dir/link", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := db.ReadLink("dir/link"); err != nil || target != "file" {
+		t.Fatalf("ReadLink: %q, %v", target, err)
+	}
+	if _, err := db.ReadLink("dir/file"); err == nil {
+		t.Fatalf("ReadLink on a regular value should fail")
+	}
+	if _, err := db.ReadLink("missing"); !os.IsNotExist(err) {
+		t.Fatalf("ReadLink on a missing key: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "dir/\ndir/file = data\ndir/link -> file\n" {
+		t.Fatalf("%s", buf.String())
+	}
+	dir, err := db.Checkout(path.Join(tmp, "checkout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(path.Join(dir, "dir/link")); err != nil || target != "file" {
+		t.Fatalf("checked out link: %q, %v", target, err)
+	}
+}
+
+func TestCountTotalSize(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if n, err := db.Count("/"); err != nil || n != 0 {
+		t.Fatalf("empty: %d, %v", n, err)
+	}
+	for key, value := range map[string]string{"a": "1", "b/c": "22", "b/d/e": "333", "b/d/f": "333"} {
+		if err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Mkdir("empty"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		key   string
+		count int
+		size  int64
+	}{
+		{"/", 4, 9},
+		{"b", 3, 8},
+		{"b/d", 2, 6},
+		{"empty", 0, 0},
+	} {
+		if n, err := db.Count(test.key); err != nil || n != test.count {
+			t.Fatalf("%s: count %d, %v, expected %d", test.key, n, err, test.count)
+		}
+		if size, err := db.TotalSize(test.key); err != nil || size != test.size {
+			t.Fatalf("%s: size %d, %v, expected %d", test.key, size, err, test.size)
+		}
+	}
+	if _, err := db.Count("missing"); !os.IsNotExist(err) {
+		t.Fatalf("missing: expected a not exist error, got %v", err)
+	}
+	if _, err := db.TotalSize("a"); !errors.Is(err, ErrNotADirectory) {
+		t.Fatalf("a: expected ErrNotADirectory, got %v", err)
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(path.Join(tmp, "db"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.Set("kept", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("a/blob", "old"); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"a/x":      "1",
+		"a/blob/y": "2",
+		"b/c/d":    "3",
+		"kept2":    "",
+	}
+	if err := db.SetMany(values); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"a/\n" +
+		"a/blob/\n" +
+		"a/blob/y = 2\n" +
+		"a/x = 1\n" +
+		"b/\n" +
+		"b/c/\n" +
+		"b/c/d = 3\n" +
+		"kept = old\n" +
+		"kept2 = \n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	// The same values set one by one give the same tree
+	other, err := Init(path.Join(tmp, "other"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Free()
+	for key, value := range map[string]string{"kept": "old", "a/blob": "old"} {
+		if err := other.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, value := range values {
+		if err := other.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a, b := db.Latest(), other.Latest(); a.String() != b.String() {
+		t.Fatalf("SetMany: %v, Set: %v", a, b)
+	}
+	// Scoped
+	if err := db.Scope("b").SetMany(map[string]string{"c/e": "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("b/c/e"); err != nil || val != "4" {
+		t.Fatalf("b/c/e = %q, %v", val, err)
+	}
+	for _, bad := range []map[string]string{
+		{"x": "1", "x/y": "2"},
+		{"/": "1"},
+		{"../x": "1"},
+	} {
+		if err := db.SetMany(bad); err == nil {
+			t.Fatalf("%v: expected an error", bad)
+		}
+	}
+	if ok, err := db.Exists("x"); err != nil || ok {
+		t.Fatalf("a failed SetMany should set nothing (%v)", err)
+	}
+}
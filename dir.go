@@ -0,0 +1,303 @@
+package libpack
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	git "github.com/libgit2/git2go"
+
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
+)
+
+// DirOptions configures SetDir.
+type DirOptions struct {
+	// Excludes and Includes select files like the options of the same
+	// name of docker's archive.TarWithOptions: Includes lists the paths
+	// to walk, relative to the directory (by default, all of it), and
+	// paths matching one of the Excludes patterns are skipped.
+	Excludes []string
+	Includes []string
+	// FollowSymlinks stores the files and directories which symlinks
+	// point to, instead of the symlinks, like `tar -h`. This includes
+	// the directory itself. A symlink to one of its parent directories
+	// is an error.
+	FollowSymlinks bool
+	// Progress, if set, is called after each file is stored.
+	Progress func(ProgressEvent)
+	// Workers is the number of files read and stored concurrently.
+	// It defaults to the number of CPUs.
+	Workers int
+}
+
+// SetDir stores the contents of the directory `dir` in the uncommitted
+// tree, in the same layout as SetTar, without the round trip through a
+// tar stream: the resulting tree is the same as after importing the
+// archive produced by docker's archive.TarWithOptions with the same
+// options, unless FollowSymlinks is set. Like docker, only the "security.capability" extended
+// attribute is stored.
+//
+// The contents of regular files are stored concurrently, while the tree
+// itself is updated in the order of the walk.
+func (db *DB) SetDir(dir string, opts *DirOptions) (*ImportStats, error) {
+	if opts == nil {
+		opts = &DirOptions{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	files, err := walkDir(dir, opts.Includes, opts.Excludes, opts.FollowSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.upgradeTarLayout(); err != nil {
+		return nil, err
+	}
+	seq, err := db.nextSeq()
+	if err != nil {
+		return nil, err
+	}
+	// Feed the regular files to the workers, in order, until all of
+	// them are stored or SetDir returns.
+	var (
+		jobs  = make(chan *dirFile)
+		quit  = make(chan struct{})
+		tasks sync.WaitGroup
+	)
+	defer func() {
+		close(quit)
+		tasks.Wait()
+	}()
+	go func() {
+		defer close(jobs)
+		for _, f := range files {
+			if f.done == nil {
+				continue
+			}
+			select {
+			case jobs <- f:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	workerStats := make([]ImportStats, workers)
+	for i := 0; i < workers; i++ {
+		tasks.Add(1)
+		go func(stats *ImportStats) {
+			defer tasks.Done()
+			for f := range jobs {
+				f.id, f.err = db.storeDirFile(f, stats)
+				close(f.done)
+			}
+		}(&workerStats[i])
+	}
+	var progress ProgressEvent
+	for _, f := range files {
+		if err := db.storeHeader(f.hdr, seq); err != nil {
+			return nil, err
+		}
+		seq++
+		key := dataPath(f.hdr.Name)
+		switch f.hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			<-f.done
+			if f.err != nil {
+				return nil, fmt.Errorf("%s: %v", f.path, f.err)
+			}
+			if err := db.setId(key, f.id, fileMode(f.hdr)); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			if err := db.SetLink(key, f.hdr.Linkname); err != nil {
+				return nil, err
+			}
+		}
+		db.debugf("stored %s (%d bytes)", f.hdr.Name, f.hdr.Size)
+		if opts.Progress != nil {
+			progress.Name = f.hdr.Name
+			progress.Bytes += f.hdr.Size
+			progress.Files++
+			progress.TotalFiles = len(files)
+			opts.Progress(progress)
+		}
+	}
+	if err := db.Set(attrPath("/", "nextseq"), strconv.Itoa(seq)); err != nil {
+		return nil, err
+	}
+	// All files are stored: the workers are idle.
+	stats := &ImportStats{}
+	for i := range workerStats {
+		stats.add(&workerStats[i])
+	}
+	return stats, nil
+}
+
+// dirFile is a file found by walkDir.
+type dirFile struct {
+	path string
+	hdr  *tar.Header
+	// For regular files, done is closed once the content is
+	// stored as the blob `id`, or failed with `err`.
+	done chan struct{}
+	id   *git.Oid
+	err  error
+}
+
+// storeDirFile stores the content of the regular file `f`. The file may
+// change after it was listed: exactly the size recorded in its header
+// is stored, or an error is returned if it is now shorter.
+func (db *DB) storeDirFile(f *dirFile, stats *ImportStats) (*git.Oid, error) {
+	src, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return db.storeBlob(io.NewSectionReader(src, 0, f.hdr.Size), f.hdr.Size, stats)
+}
+
+// walkDir lists the files of `dir` selected by `includes` and
+// `excludes`, in the order and with the headers which docker's
+// archive.TarWithOptions would use. If `follow` is true, symlinks are
+// listed as the files or directories they point to.
+func walkDir(dir string, includes, excludes []string, follow bool) ([]*dirFile, error) {
+	if len(includes) == 0 {
+		includes = []string{"."}
+	}
+	w := &dirWalker{dir: dir, excludes: excludes, follow: follow}
+	for _, include := range includes {
+		p := filepath.Join(dir, include)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.walk(p, fi); err != nil {
+			return nil, err
+		}
+	}
+	return w.files, nil
+}
+
+// dirWalker walks a directory for walkDir. Like filepath.Walk, it
+// lists the contents of each directory in lexical order.
+type dirWalker struct {
+	dir      string
+	excludes []string
+	follow   bool
+	files    []*dirFile
+	// parents are the directories being walked, to detect symlinks
+	// pointing to one of them.
+	parents []os.FileInfo
+}
+
+// walk lists the file at `p`, described by `fi`, and, if it is a
+// directory, its contents.
+func (w *dirWalker) walk(p string, fi os.FileInfo) error {
+	name, err := filepath.Rel(w.dir, p)
+	if err != nil {
+		return err
+	}
+	if skip, err := matchesExclude(name, w.excludes); err != nil || skip {
+		return err
+	}
+	if w.follow && fi.Mode()&os.ModeSymlink != 0 {
+		if fi, err = os.Stat(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := fileHeader(p, name, fi)
+	if err != nil {
+		return err
+	}
+	f := &dirFile{path: p, hdr: hdr}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		f.done = make(chan struct{})
+	}
+	w.files = append(w.files, f)
+	if !fi.IsDir() {
+		return nil
+	}
+	for _, parent := range w.parents {
+		if os.SameFile(parent, fi) {
+			return fmt.Errorf("%s: symlink to a parent directory", p)
+		}
+	}
+	d, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	w.parents = append(w.parents, fi)
+	defer func() { w.parents = w.parents[:len(w.parents)-1] }()
+	for _, n := range names {
+		child := filepath.Join(p, n)
+		cfi, err := os.Lstat(child)
+		if err != nil {
+			return err
+		}
+		if err := w.walk(child, cfi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesExclude returns true if `name` matches one of the patterns
+// `excludes`. The directory itself is never excluded.
+func matchesExclude(name string, excludes []string) (bool, error) {
+	if filepath.Clean(name) == "." {
+		return false, nil
+	}
+	for _, exclude := range excludes {
+		matched, err := filepath.Match(exclude, name)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fileHeader returns the tar header of the file at `p`, stored in the
+// archive as `name`.
+func fileHeader(p, name string, fi os.FileInfo) (*tar.Header, error) {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() && !strings.HasSuffix(name, "/") {
+		name = name + "/"
+	}
+	hdr.Name = name
+	if hdr.Xattrs, err = fileXattrs(p, hdr.Typeflag == tar.TypeSymlink); err != nil {
+		return nil, err
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && (hdr.Typeflag == tar.TypeBlock || hdr.Typeflag == tar.TypeChar) {
+		// FileInfoHeader does not fill in the device numbers
+		hdr.Devmajor = int64((stat.Rdev >> 8) & 0xfff)
+		hdr.Devminor = int64((stat.Rdev & 0xff) | ((stat.Rdev >> 12) & 0xfff00))
+	}
+	return hdr, nil
+}
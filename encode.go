@@ -0,0 +1,118 @@
+package libpack
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Encode stores `val` in db at `key`. Structs, maps, slices and arrays
+// are stored as subtrees: each exported field of a struct is stored
+// under its name, each entry of a map under its key, and each element
+// of a slice or array under its index ("0", "1", ...). Strings,
+// booleans and numbers are stored as values, in their usual Go
+// formatting, and byte slices as raw values.
+// Pointers and interfaces are stored as the value they point to. Nil
+// pointers, interfaces, maps and slices are omitted, as are unexported
+// fields.
+// If there is already a subtree at `key`, the encoded tree is merged
+// into it: keys which are not part of `val` are left untouched.
+func (db *DB) Encode(key string, val interface{}) error {
+	id, mode, err := db.encode(reflect.ValueOf(val))
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", key, err)
+	}
+	if id == nil {
+		return nil
+	}
+	return db.setId(key, id, mode)
+}
+
+// encode stores `v` in a new blob or tree, without changing the tree
+// of db, and returns its id and git filemode. If `v` is omitted, a nil
+// id is returned.
+func (db *DB) encode(v reflect.Value) (*git.Oid, int, error) {
+	var value string
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, 0, nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, 0, nil
+		}
+		return db.encode(v.Elem())
+	case reflect.Struct:
+		return db.encodeTree(v.NumField(), func(i int) (string, reflect.Value, bool) {
+			f := v.Type().Field(i)
+			return f.Name, v.Field(i), f.PkgPath == ""
+		})
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, 0, nil
+		}
+		keys := v.MapKeys()
+		return db.encodeTree(len(keys), func(i int) (string, reflect.Value, bool) {
+			return fmt.Sprint(keys[i].Interface()), v.MapIndex(keys[i]), true
+		})
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, 0, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			value = string(data)
+			break
+		}
+		return db.encodeTree(v.Len(), func(i int) (string, reflect.Value, bool) {
+			return strconv.Itoa(i), v.Index(i), true
+		})
+	case reflect.String:
+		value = v.String()
+	case reflect.Bool:
+		value = strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		value = strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		value = strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	default:
+		return nil, 0, fmt.Errorf("can't encode values of type %s", v.Type())
+	}
+	id, err := db.createBlob(value)
+	return id, 0100644, err
+}
+
+// encodeTree stores the `n` entries returned by `entry` in a new tree.
+// Entries for which `entry` returns false are skipped.
+func (db *DB) encodeTree(n int, entry func(int) (string, reflect.Value, bool)) (*git.Oid, int, error) {
+	builder, err := db.repo.TreeBuilder()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer builder.Free()
+	for i := 0; i < n; i++ {
+		name, v, ok := entry(i)
+		if !ok {
+			continue
+		}
+		if !validName(name) {
+			return nil, 0, fmt.Errorf("%q: %w", name, ErrInvalidPath)
+		}
+		id, mode, err := db.encode(v)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", name, err)
+		}
+		if id == nil {
+			continue
+		}
+		if err := builder.Insert(name, id, mode); err != nil {
+			return nil, 0, err
+		}
+	}
+	id, err := builder.Write()
+	return id, 040000, err
+}
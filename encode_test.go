@@ -0,0 +1,91 @@
+package libpack
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+type encodeConfig struct {
+	Name    string
+	Port    int
+	Debug   bool
+	Ratio   float64
+	Tags    []string
+	Env     map[string]string
+	Backend *encodeConfig
+	Raw     []byte
+	Missing *encodeConfig
+	private string
+}
+
+func TestEncode(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.Set("app/Extra", "kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("app/Port", "1"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &encodeConfig{
+		Name:    "web",
+		Port:    8080,
+		Debug:   true,
+		Ratio:   0.5,
+		Tags:    []string{"a", "b"},
+		Env:     map[string]string{"PATH": "/bin"},
+		Backend: &encodeConfig{Name: "db"},
+		Raw:     []byte{0, 1},
+		private: "hidden",
+	}
+	if err := db.Encode("app", cfg); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"app/\n" +
+		"app/Backend/\n" +
+		"app/Backend/Debug = false\n" +
+		"app/Backend/Name = db\n" +
+		"app/Backend/Port = 0\n" +
+		"app/Backend/Ratio = 0\n" +
+		"app/Debug = true\n" +
+		"app/Env/\n" +
+		"app/Env/PATH = /bin\n" +
+		"app/Extra = kept\n" +
+		"app/Name = web\n" +
+		"app/Port = 8080\n" +
+		"app/Ratio = 0.5\n" +
+		"app/Raw = \x00\x01\n" +
+		"app/Tags/\n" +
+		"app/Tags/0 = a\n" +
+		"app/Tags/1 = b\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if err := db.Encode("scalar", 42); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("scalar"); err != nil || value != "42" {
+		t.Fatalf("scalar: %q, %v", value, err)
+	}
+	if err := db.Encode("bad", map[string]interface{}{"f": func() {}}); err == nil {
+		t.Fatalf("encoding a func should fail")
+	}
+	if err := db.Encode("bad", map[string]int{"a/b": 1}); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("expected ErrInvalidPath, got %v", err)
+	}
+	if ok, err := db.Exists("bad"); err != nil || ok {
+		t.Fatalf("bad: a failed Encode should store nothing (%v)", err)
+	}
+}
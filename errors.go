@@ -0,0 +1,74 @@
+package libpack
+
+import (
+	"errors"
+	"os"
+	"regexp"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Errors returned by the package. They may be wrapped with the key or
+// hash they apply to: test for them with errors.Is.
+var (
+	// ErrNotExist is returned when a key doesn't exist. It is
+	// os.ErrNotExist, and wrapped in an *os.PathError, so that
+	// os.IsNotExist(err) holds too.
+	ErrNotExist = os.ErrNotExist
+	// ErrNotADirectory is returned when a subtree is expected, but
+	// the key holds a blob.
+	ErrNotADirectory = errors.New("not a directory")
+	// ErrNotABlob is returned when a value is expected, but the key
+	// holds a subtree.
+	ErrNotABlob = errors.New("not a blob")
+	// ErrNoRef is returned when the reference of a database doesn't
+	// exist, ie nothing was committed yet.
+	ErrNoRef = errors.New("no such reference")
+	// ErrConflict is returned when a reference can't be updated
+	// because it moved in the meantime, or the update is not a
+	// fast-forward.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidPath is returned when a key resolves outside of the
+	// scope of a database, for example "../foo".
+	ErrInvalidPath = errors.New("invalid path")
+)
+
+// notExist returns the error reporting that `key` doesn't exist.
+func notExist(key string) error {
+	return &os.PathError{Op: "lookup", Path: key, Err: ErrNotExist}
+}
+
+// isNotFound returns true if `err` is a libgit2 error reporting a
+// missing object or tree entry.
+func isNotFound(err error) bool {
+	var gitErr *git.GitError
+	return errors.As(err, &gitErr) && gitErr.Code == git.ErrNotFound
+}
+
+// noRefMessage matches the message of libgit2 errors reporting a
+// missing reference. It is only used for errors which don't carry a
+// libgit2 error code.
+var noRefMessage = regexp.MustCompile(`[Rr]eference '.*' not found`)
+
+// IsNoRef returns true if `err` reports that a git reference does not
+// exist, as opposed to any other failure to read it (for example a
+// corrupted reference). `err` may be wrapped. It is true for ErrNoRef.
+func IsNoRef(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNoRef) {
+		return true
+	}
+	var gitErr *git.GitError
+	if errors.As(err, &gitErr) {
+		if gitErr.Code == git.ErrNotFound && gitErr.Class == git.ErrClassReference {
+			return true
+		}
+		if gitErr.Code != git.ErrGeneric {
+			return false
+		}
+	}
+	// Last resort: the error code was lost, or libgit2 didn't set one.
+	return noRefMessage.MatchString(err.Error())
+}
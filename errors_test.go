@@ -0,0 +1,63 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestIsNoRef(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	r, err := git.InitRepository(tmp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Free()
+	_, err = r.LookupReference("refs/heads/missing")
+	if err == nil {
+		t.Fatalf("looking up a missing reference should fail")
+	}
+	if !IsNoRef(err) {
+		t.Fatalf("IsNoRef(%v) should be true", err)
+	}
+	if wrapped := fmt.Errorf("update: %w", err); !IsNoRef(wrapped) {
+		t.Fatalf("IsNoRef(%v) should be true", wrapped)
+	}
+	// A corrupted reference exists: it must not be mistaken for a
+	// missing one.
+	if err := ioutil.WriteFile(path.Join(tmp, "refs/heads/broken"), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.LookupReference("refs/heads/broken")
+	if err == nil {
+		t.Fatalf("looking up a corrupted reference should fail")
+	}
+	if IsNoRef(err) {
+		t.Fatalf("IsNoRef(%v) should be false", err)
+	}
+	if IsNoRef(nil) || IsNoRef(errors.New("not found")) {
+		t.Fatalf("IsNoRef should only match missing references")
+	}
+}
+
+func TestOpenBrokenRef(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Free()
+	if err := ioutil.WriteFile(path.Join(tmp, "refs/heads/test"), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(tmp, "refs/heads/test", ""); err == nil {
+		t.Fatalf("opening a database with a corrupted reference should fail")
+	}
+}
@@ -0,0 +1,113 @@
+package libpack
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Glob returns the keys matching `pattern`, in lexicographic order.
+// Each component of the pattern is matched with path.Match against
+// one component of the key, except "**", which matches any number of
+// components. For example "services/*/config" matches
+// "services/web/config", and "services/**/config" also matches
+// "services/config" and "services/web/v1/config".
+// Both values and subtrees are matched. Only the subtree at the fixed
+// prefix of the pattern, "services" in these examples, is walked.
+// If nothing matches, an empty slice is returned.
+func (db *DB) Glob(pattern string) ([]string, error) {
+	clean, err := scopedPath("", pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	if clean == "/" {
+		return matches, nil
+	}
+	parts := strings.Split(clean, "/")
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, err
+		}
+	}
+	// Walk from the longest prefix without wildcards, keeping at
+	// least one component to match.
+	var prefix []string
+	for len(prefix) < len(parts)-1 && !hasMeta(parts[len(prefix)]) {
+		prefix = append(prefix, parts[len(prefix)])
+	}
+	parts = parts[len(prefix):]
+	base := path.Join(prefix...)
+	p, err := db.fullPath(base)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := db.currentSubtree(p)
+	if errors.Is(err, ErrNotExist) || errors.Is(err, ErrNotADirectory) {
+		return matches, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return matches, nil
+	}
+	defer tree.Free()
+	err = tree.Walk(func(parent string, e *git.TreeEntry) int {
+		rel := path.Join(parent, e.Name)
+		key := strings.Split(rel, "/")
+		if globMatch(parts, key) {
+			matches = append(matches, path.Join(base, rel))
+		}
+		if e.Type == git.ObjectTree && !globDescend(parts, key) {
+			// Nothing under this subtree can match
+			return 1
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// hasMeta returns true if the pattern component `part` has any
+// wildcard.
+func hasMeta(part string) bool {
+	return strings.ContainsAny(part, `*?[\`)
+}
+
+// globMatch returns true if the key components `key` match the
+// pattern components `pattern`.
+func globMatch(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	if pattern[0] == "**" {
+		return globMatch(pattern[1:], key) || (len(key) > 0 && globMatch(pattern, key[1:]))
+	}
+	if len(key) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], key[0])
+	return ok && globMatch(pattern[1:], key[1:])
+}
+
+// globDescend returns true if a key under the subtree `dir` may match
+// the pattern components `pattern`.
+func globDescend(pattern, dir []string) bool {
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	if len(dir) == 0 {
+		return true
+	}
+	ok, _ := path.Match(pattern[0], dir[0])
+	return ok && globDescend(pattern[1:], dir[1:])
+}
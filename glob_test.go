@@ -0,0 +1,61 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for _, key := range []string{
+		"services/config",
+		"services/web/config",
+		"services/web/v1/config",
+		"services/db/config",
+		"services/db/data",
+		"other/config",
+	} {
+		if err := db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pattern, expected := range map[string]string{
+		"services/*/config":  "[services/db/config services/web/config]",
+		"services/**/config": "[services/config services/db/config services/web/config services/web/v1/config]",
+		"**/config":          "[other/config services/config services/db/config services/web/config services/web/v1/config]",
+		"/services/d?/*":     "[services/db/config services/db/data]",
+		"services/*":         "[services/config services/db services/web]",
+		"services/web":       "[services/web]",
+		"*":                  "[other services]",
+		"services/nope/*":    "[]",
+		"services/config/*":  "[]",
+		"missing/**":         "[]",
+		"":                   "[]",
+	} {
+		matches, err := db.Glob(pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		if fmt.Sprintf("%v", matches) != expected {
+			t.Fatalf("%s: expected %s, got %v", pattern, expected, matches)
+		}
+	}
+	if matches, err := db.Scope("services").Glob("*/config"); err != nil || fmt.Sprintf("%v", matches) != "[db/config web/config]" {
+		t.Fatalf("scoped: %v, %v", matches, err)
+	}
+	if _, err := db.Glob("services/[/config"); err != path.ErrBadPattern {
+		t.Fatalf("bad pattern: %v", err)
+	}
+	if _, err := db.Glob("../*"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("escaping pattern: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package libpack
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	git "github.com/libgit2/git2go"
+)
+
+// base64Prefix marks the values encoded in base64 by DumpJSON.
+const base64Prefix = "base64:"
+
+// DumpJSON writes the contents of db to `dst` as a JSON object, in
+// which subtrees are nested objects and values are strings, with keys
+// sorted. Values which are not valid UTF-8, or which start with
+// "base64:", are written as "base64:" followed by their base64
+// encoding.
+// Filemodes are not recorded: values are loaded back by LoadJSON as
+// regular, non-executable files.
+func (db *DB) DumpJSON(dst io.Writer) error {
+	top := map[string]interface{}{}
+	dirs := map[string]map[string]interface{}{"": top}
+	err := db.Walk("/", func(key string, obj git.Object) error {
+		dir, name := path.Split(key)
+		parent := dirs[strings.TrimSuffix(dir, "/")]
+		switch obj := obj.(type) {
+		case *git.Tree:
+			sub := map[string]interface{}{}
+			dirs[key] = sub
+			parent[name] = sub
+		case *git.Blob:
+			parent[name] = encodeJSONValue(obj.Contents())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(dst)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(top)
+}
+
+// LoadJSON reads a JSON object in the format written by DumpJSON from
+// `src`, and stores its contents in db. Existing keys which are not in
+// the object are left untouched, so loading a dump in an empty
+// database reproduces the tree it was dumped from.
+func (db *DB) LoadJSON(src io.Reader) error {
+	var top map[string]interface{}
+	if err := json.NewDecoder(src).Decode(&top); err != nil {
+		return err
+	}
+	return db.loadJSON("", top)
+}
+
+func (db *DB) loadJSON(dir string, obj map[string]interface{}) error {
+	if len(obj) == 0 && dir != "" {
+		return db.Mkdir(dir)
+	}
+	for name, v := range obj {
+		if !validName(name) {
+			return fmt.Errorf("%q: %w", path.Join(dir, name), ErrInvalidPath)
+		}
+		key := path.Join(dir, name)
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := db.loadJSON(key, v); err != nil {
+				return err
+			}
+		case string:
+			value, err := decodeJSONValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if err := db.Set(key, value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: expected a string or an object, got %T", key, v)
+		}
+	}
+	return nil
+}
+
+// encodeJSONValue returns the representation of the value `data` in the
+// output of DumpJSON.
+func encodeJSONValue(data []byte) string {
+	s := string(data)
+	if utf8.ValidString(s) && !strings.HasPrefix(s, base64Prefix) {
+		return s
+	}
+	return base64Prefix + base64.StdEncoding.EncodeToString(data)
+}
+
+// decodeJSONValue is the reverse of encodeJSONValue.
+func decodeJSONValue(s string) (string, error) {
+	if !strings.HasPrefix(s, base64Prefix) {
+		return s, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(s[len(base64Prefix):])
+	return string(data), err
+}
@@ -0,0 +1,76 @@
+package libpack
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDumpLoadJSON(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(path.Join(tmp, "a"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	for key, value := range map[string]string{
+		"dir/text":  "line 1\nline 2",
+		"dir/sub/x": "<x & y>",
+		"binary":    "\xff\x00",
+		"ambiguous": "base64:x",
+		"top":       "",
+	} {
+		if err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Mkdir("dir/empty"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.DumpJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"ambiguous":"base64:YmFzZTY0Ong=","binary":"base64:/wA=",` +
+		`"dir":{"empty":{},"sub":{"x":"<x & y>"},"text":"line 1\nline 2"},"top":""}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	other, err := Init(path.Join(tmp, "b"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Free()
+	if err := other.LoadJSON(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := other.Get("binary"); err != nil || value != "\xff\x00" {
+		t.Fatalf("binary: %q, %v", value, err)
+	}
+	before, err := db.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := other.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Hash.String() != after.Hash.String() {
+		t.Fatalf("tree %v was loaded back as %v", before.Hash, after.Hash)
+	}
+
+	for _, bad := range []string{`{"a/b":"x"}`, `{"..":"x"}`, `{"a":1}`, `["a"]`} {
+		err := other.LoadJSON(strings.NewReader(bad))
+		if err == nil {
+			t.Fatalf("%s: expected an error", bad)
+		}
+		if strings.Contains(bad, "/") && !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("%s: expected ErrInvalidPath, got %v", bad, err)
+		}
+	}
+}
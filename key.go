@@ -0,0 +1,77 @@
+package libpack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// validName returns true if `name` can be used as the name of a single
+// tree entry: it is not empty, "." or "..", it has no slash or NUL
+// byte, and it is not ".git" in any case, which git refuses to check
+// out.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\x00") && !strings.EqualFold(name, ".git")
+}
+
+// escapePath escapes each component of the path `p` with EscapeKey.
+// The result is in the format returned by TreePath.
+func escapePath(p string) string {
+	p = TreePath(p)
+	if p == "/" {
+		return p
+	}
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = EscapeKey(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// EscapeKey returns a valid key component, which UnescapeKey maps back
+// to `s`, for any string `s`. Slashes, NUL bytes and "%" are
+// percent-encoded, as is the leading dot of ".", ".." and ".git". The
+// empty string is escaped as "%". Other strings are left unchanged.
+func EscapeKey(s string) string {
+	if s == "" {
+		return "%"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '/' || c == 0 || c == '%':
+			fmt.Fprintf(&b, "%%%02X", c)
+		case i == 0 && (s == "." || s == ".." || strings.EqualFold(s, ".git")):
+			b.WriteString("%2E")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeKey is the reverse of EscapeKey. An error is returned if `s`
+// was not returned by EscapeKey.
+func UnescapeKey(s string) (string, error) {
+	if s == "%" {
+		return "", nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("%q: malformed escape", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("%q: malformed escape", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
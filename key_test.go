@@ -0,0 +1,36 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestEscapeKey(t *testing.T) {
+	for s, escaped := range map[string]string{
+		"":           "%",
+		"foo":        "foo",
+		".":          "%2E",
+		"..":         "%2E.",
+		"...":        "...",
+		".git":       "%2Egit",
+		".Git":       "%2EGit",
+		".gitignore": ".gitignore",
+		"a/b":        "a%2Fb",
+		"100%":       "100%25",
+		"a\x00b":     "a%00b",
+	} {
+		if result := EscapeKey(s); result != escaped {
+			t.Fatalf("EscapeKey(%q): expected %q, got %q", s, escaped, result)
+		}
+		if !validName(escaped) {
+			t.Fatalf("EscapeKey(%q): %q is not a valid name", s, escaped)
+		}
+		if result, err := UnescapeKey(escaped); err != nil || result != s {
+			t.Fatalf("UnescapeKey(%q): %q, %v", escaped, result, err)
+		}
+	}
+	for _, s := range []string{"%2", "%zz", "a%", "%+1"} {
+		if _, err := UnescapeKey(s); err == nil {
+			t.Fatalf("UnescapeKey(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package libpack
+
+// Logger receives debug information from a DB.
+// By default, a DB doesn't log anything.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+}
+
+// SetLogger sets the logger which receives debug information from db
+// and from the databases scoped from it. A nil logger disables logging.
+func (db *DB) SetLogger(l Logger) {
+	if db.parent != nil {
+		db.parent.SetLogger(l)
+		return
+	}
+	db.logger = l
+}
+
+func (db *DB) debugf(format string, args ...interface{}) {
+	if db.parent != nil {
+		db.parent.debugf(format, args...)
+		return
+	}
+	if db.logger != nil {
+		db.logger.Debugf(format, args...)
+	}
+}
@@ -0,0 +1,245 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	git "github.com/libgit2/git2go"
+)
+
+// MergeStrategy selects how MergeTrees resolves conflicts, ie keys
+// changed differently on both sides.
+type MergeStrategy int
+
+const (
+	// MergeFail fails the merge if there is any conflict. It is the
+	// default strategy of a DB.
+	MergeFail MergeStrategy = iota
+	// MergeOurs keeps our side of each conflict.
+	MergeOurs
+	// MergeTheirs keeps their side of each conflict.
+	MergeTheirs
+)
+
+// Conflict is a key changed differently on both sides of a merge.
+type Conflict struct {
+	Key string
+	// Ours and Theirs are the ids of the object at Key on each side,
+	// or nil if it was deleted on that side.
+	Ours, Theirs *git.Oid
+}
+
+// MergeError is returned when a merge fails because of conflicts. It
+// wraps ErrConflict.
+type MergeError struct {
+	// Conflicts are the conflicting keys, in lexicographic order.
+	Conflicts []Conflict
+}
+
+func (e *MergeError) Error() string {
+	return fmt.Sprintf("%d conflicting keys, first %s: %v", len(e.Conflicts), e.Conflicts[0].Key, ErrConflict)
+}
+
+func (e *MergeError) Unwrap() error {
+	return ErrConflict
+}
+
+// MergeTrees performs a three-way merge of the trees `ours` and
+// `theirs`, whose common ancestor is `base`. A key changed on one side
+// only takes the value of that side. A subtree changed on both sides is
+// merged recursively. Any other key changed differently on both sides
+// is a conflict, resolved according to `strategy`.
+// With a nil `base`, the result is the union of both trees.
+//
+// The conflicts are returned in lexicographic order of their keys.
+// With MergeFail, if there are conflicts, no tree is returned, and the
+// error is a *MergeError. Otherwise the new tree is returned, and must
+// be freed by the caller. `ours`, `theirs` and `base` may be nil, for
+// an empty tree.
+func MergeTrees(repo *git.Repository, ours, theirs, base *git.Tree, strategy MergeStrategy) (*git.Tree, []Conflict, error) {
+	var conflicts []Conflict
+	id, err := mergeTrees(repo, ours, theirs, base, "", strategy, &conflicts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strategy == MergeFail && len(conflicts) > 0 {
+		return nil, conflicts, &MergeError{Conflicts: conflicts}
+	}
+	tree, err := lookupTree(repo, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, conflicts, nil
+}
+
+// mergeTrees writes the result of MergeTrees for the subtrees at `dir`,
+// and appends their conflicts to `conflicts`.
+func mergeTrees(repo *git.Repository, ours, theirs, base *git.Tree, dir string, strategy MergeStrategy, conflicts *[]Conflict) (*git.Oid, error) {
+	builder, err := repo.TreeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+	for _, name := range entryNames(ours, theirs, base) {
+		o, t, b := entryByName(ours, name), entryByName(theirs, name), entryByName(base, name)
+		var result *git.TreeEntry
+		switch {
+		case sameEntry(o, t), sameEntry(t, b):
+			result = o
+		case sameEntry(o, b):
+			result = t
+		case o != nil && t != nil && o.Type == git.ObjectTree && t.Type == git.ObjectTree:
+			id, err := mergeSubtrees(repo, o, t, b, path.Join(dir, name), strategy, conflicts)
+			if err != nil {
+				return nil, err
+			}
+			result = &git.TreeEntry{Name: name, Id: id, Type: git.ObjectTree, Filemode: 040000}
+		default:
+			c := Conflict{Key: path.Join(dir, name)}
+			if o != nil {
+				c.Ours = o.Id
+			}
+			if t != nil {
+				c.Theirs = t.Id
+			}
+			*conflicts = append(*conflicts, c)
+			result = o
+			if strategy == MergeTheirs {
+				result = t
+			}
+		}
+		if result == nil {
+			continue
+		}
+		if err := builder.Insert(name, result.Id, result.Filemode); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Write()
+}
+
+// mergeSubtrees merges the subtrees of the entries `o` and `t`, with
+// the entry `b` as their common ancestor if it is a subtree.
+func mergeSubtrees(repo *git.Repository, o, t, b *git.TreeEntry, dir string, strategy MergeStrategy, conflicts *[]Conflict) (*git.Oid, error) {
+	ours, err := lookupTree(repo, o.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer ours.Free()
+	theirs, err := lookupTree(repo, t.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer theirs.Free()
+	var base *git.Tree
+	if b != nil && b.Type == git.ObjectTree {
+		if base, err = lookupTree(repo, b.Id); err != nil {
+			return nil, err
+		}
+		defer base.Free()
+	}
+	return mergeTrees(repo, ours, theirs, base, dir, strategy, conflicts)
+}
+
+// entryNames returns the names of the entries of all `trees`, sorted
+// and without duplicates. Nil trees are ignored.
+func entryNames(trees ...*git.Tree) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, tree := range trees {
+		if tree == nil {
+			continue
+		}
+		for i := uint64(0); i < tree.EntryCount(); i++ {
+			name := tree.EntryByIndex(i).Name
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// entryByName returns the entry `name` of `tree`, or nil if there is
+// none or `tree` is nil.
+func entryByName(tree *git.Tree, name string) *git.TreeEntry {
+	if tree == nil {
+		return nil
+	}
+	return tree.EntryByName(name)
+}
+
+// sameEntry returns true if the entries `a` and `b` are both missing,
+// or point to the same object with the same filemode.
+func sameEntry(a, b *git.TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Id.Equal(b.Id) && a.Filemode == b.Filemode
+}
+
+// SetMergeStrategy sets how Pull resolves conflicts between the
+// uncommitted changes of db, and of the databases scoped from it, and
+// the changes pulled. The default is MergeFail.
+func (db *DB) SetMergeStrategy(strategy MergeStrategy) {
+	if db.parent != nil {
+		db.parent.SetMergeStrategy(strategy)
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.merge = strategy
+}
+
+// mergeRef moves db to the commit of its reference, and merges the
+// uncommitted changes of db into its tree: the changes are those between
+// the tree of the previous commit and the current tree. Conflicts are
+// resolved with the merge strategy of db. If the merge fails, db is left
+// unchanged, and the error is returned as is.
+// The caller must hold the write lock of the root database db.
+func (db *DB) mergeRef() error {
+	tip, err := db.repo.LookupReference(db.ref)
+	if IsNoRef(err) {
+		return db.update()
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", db.ref, err)
+	}
+	defer tip.Free()
+	if db.commit != nil && db.commit.Id().Equal(tip.Target()) {
+		return nil
+	}
+	var base *git.Tree
+	if db.commit != nil {
+		if base, err = db.commit.Tree(); err != nil {
+			return err
+		}
+		defer base.Free()
+	}
+	commit, err := db.lookupCommit(tip.Target())
+	if err != nil {
+		return err
+	}
+	theirs, err := commit.Tree()
+	if err != nil {
+		commit.Free()
+		return err
+	}
+	defer theirs.Free()
+	merged, conflicts, err := MergeTrees(db.repo, db.tree, theirs, base, db.merge)
+	if err != nil {
+		commit.Free()
+		return err
+	}
+	for _, c := range conflicts {
+		db.debugf("merge conflict on %s: ours %v, theirs %v", c.Key, c.Ours, c.Theirs)
+	}
+	if db.commit != nil {
+		db.commit.Free()
+	}
+	db.commit = commit
+	db.setTree(merged)
+	return nil
+}
@@ -0,0 +1,106 @@
+package libpack
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestMergeTrees(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	r, err := git.InitRepository(tmp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Free()
+	tree := func(kv ...string) *git.Tree {
+		var tree *git.Tree
+		for i := 0; i < len(kv); i += 2 {
+			id, err := r.CreateBlobFromBuffer([]byte(kv[i+1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree, err = treeUpdate(r, tree, kv[i], id, 0100644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tree
+	}
+	base := tree("a", "1", "b", "1", "d/x", "1", "e", "1")
+	ours := tree("a", "2", "b", "1", "d/x", "1", "d/y", "ours")
+	theirs := tree("a", "1", "b", "3", "d/x", "1", "d/z", "theirs", "e", "1", "f", "theirs")
+	merged, conflicts, err := MergeTrees(r, ours, theirs, base, MergeFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"a = 2 (100644)\n" +
+		"b = 3 (100644)\n" +
+		"d/\n" +
+		"d/x = 1 (100644)\n" +
+		"d/y = ours (100644)\n" +
+		"d/z = theirs (100644)\n" +
+		"f = theirs (100644)\n"
+	if dump := dumpTree(t, r, merged); dump != expected || len(conflicts) != 0 {
+		t.Fatalf("expected:\n%s\ngot:\n%s%v", expected, dump, conflicts)
+	}
+	merged.Free()
+
+	// Their side changes a and d/y, and adds back e. It also deletes b
+	// and d/x, which ours didn't change.
+	theirs = tree("a", "3", "d/y", "theirs", "e", "2")
+	if _, conflicts, err = MergeTrees(r, ours, theirs, base, MergeFail); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if len(conflicts) != 3 || conflicts[0].Key != "a" || conflicts[1].Key != "d/y" || conflicts[2].Key != "e" {
+		t.Fatalf("conflicts: %v", conflicts)
+	}
+	// e was deleted on our side
+	if conflicts[2].Ours != nil || conflicts[2].Theirs == nil {
+		t.Fatalf("e: %v", conflicts[2])
+	}
+	merged, _, err = MergeTrees(r, ours, theirs, base, MergeTheirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "" +
+		"a = 3 (100644)\n" +
+		"d/\n" +
+		"d/y = theirs (100644)\n" +
+		"e = 2 (100644)\n"
+	if dump := dumpTree(t, r, merged); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+	merged.Free()
+	merged, _, err = MergeTrees(r, ours, theirs, base, MergeOurs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "" +
+		"a = 2 (100644)\n" +
+		"d/\n" +
+		"d/y = ours (100644)\n"
+	if dump := dumpTree(t, r, merged); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+	merged.Free()
+
+	// Without a base, both trees are added together
+	merged, conflicts, err = MergeTrees(r, tree("a", "1", "d/x", "1"), tree("b", "2", "d/y", "2"), nil, MergeFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "" +
+		"a = 1 (100644)\n" +
+		"b = 2 (100644)\n" +
+		"d/\n" +
+		"d/x = 1 (100644)\n" +
+		"d/y = 2 (100644)\n"
+	if dump := dumpTree(t, r, merged); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+	merged.Free()
+}
@@ -0,0 +1,104 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Push updates the reference of db in the remote repository at `url`
+// (any url understood by git) to the last commit of db. Uncommitted
+// changes are not pushed.
+// The remote only accepts fast-forward updates: otherwise ErrConflict
+// is returned. The previous value of the remote reference is returned,
+// or nil if it did not exist.
+func (db *DB) Push(url string) (*git.Oid, error) {
+	if db.parent != nil {
+		return db.parent.Push(url)
+	}
+	head := db.Head()
+	if head == nil {
+		return nil, fmt.Errorf("%s: nothing to push: %w", db.ref, ErrNoRef)
+	}
+	old, err := db.lsRemote(url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.git("push", url, head.String()+":"+db.ref); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// Pull fetches the reference of db from the remote repository at `url`
+// (any url understood by git), and updates db to point to it.
+// Only fast-forward updates of the local reference are accepted:
+// otherwise ErrConflict is returned.
+// Uncommitted changes are merged into the pulled tree, with the
+// strategy set by SetMergeStrategy. By default, any conflict fails the
+// merge with a *MergeError listing the conflicting keys.
+//
+// If the merge fails, the reference is updated, but db is left
+// unchanged: it still holds its previous commit and uncommitted
+// changes, and Commit returns ErrConflict. To complete the merge, Pull
+// again, after changing the merge strategy or the conflicting keys.
+func (db *DB) Pull(url string) error {
+	if db.parent != nil {
+		return db.parent.Pull(url)
+	}
+	// --update-head-ok: the reference may be the current branch of a
+	// non-bare repository.
+	if _, err := db.git("fetch", "--update-head-ok", url, db.ref+":"+db.ref); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	dirty, err := db.uncommitted()
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return db.mergeRef()
+	}
+	// No uncommitted changes: move to the new tree.
+	db.setTree(nil)
+	return db.update()
+}
+
+// lsRemote returns the value of the reference of db in the remote
+// repository at `url`, or nil if it does not exist.
+func (db *DB) lsRemote(url string) (*git.Oid, error) {
+	out, err := db.git("ls-remote", url, db.ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == db.ref {
+			return git.NewOid(fields[0])
+		}
+	}
+	return nil, nil
+}
+
+// git runs the git command `args` on the repository of db, and returns
+// its output. On failure, the error holds what the command printed on
+// stderr, and wraps ErrConflict if a reference update was rejected.
+func (db *DB) git(args ...string) (string, error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("git", append([]string{"--git-dir", db.repo.Path()}, args...)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "[rejected]") {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], ErrConflict, msg)
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return stdout.String(), nil
+}
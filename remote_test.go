@@ -0,0 +1,163 @@
+package libpack
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPushPull(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	remote := path.Join(tmp, "remote")
+	src, err := Init(path.Join(tmp, "src"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Free()
+	if _, err := Init(remote, "refs/heads/test", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Push(remote); !errors.Is(err, ErrNoRef) {
+		t.Fatalf("pushing without commits: expected ErrNoRef, got %v", err)
+	}
+	if err := src.Set("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := src.Push(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != nil {
+		t.Fatalf("remote reference should not exist yet, got %v", old)
+	}
+	dst, err := Init(path.Join(tmp, "dst"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Free()
+	if err := dst.Pull(remote); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Head().Equal(src.Head()) {
+		t.Fatalf("pulled %v, expected %v", dst.Head(), src.Head())
+	}
+	if val, err := dst.Get("foo"); err != nil || val != "bar" {
+		t.Fatalf("foo = %q, %v", val, err)
+	}
+	// Diverge: the remote must reject the non-fast-forward update
+	if err := dst.Set("foo", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Commit("dst"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Push(remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Set("foo", "src"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Commit("src"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Push(remote); !errors.Is(err, ErrConflict) {
+		t.Fatalf("non-fast-forward push: expected ErrConflict, got %v", err)
+	}
+	if err := src.Pull(remote); !errors.Is(err, ErrConflict) {
+		t.Fatalf("non-fast-forward pull: expected ErrConflict, got %v", err)
+	}
+}
+
+func TestPullMerge(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	remote := path.Join(tmp, "remote")
+	if _, err := Init(remote, "refs/heads/test", ""); err != nil {
+		t.Fatal(err)
+	}
+	src, err := Init(path.Join(tmp, "src"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Free()
+	dst, err := Init(path.Join(tmp, "dst"), "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Free()
+	set := func(db *DB, key, value string) {
+		if err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push := func(msg string) {
+		if err := src.Commit(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.Push(remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(key, value string) {
+		if val, err := dst.Get(key); err != nil || val != value {
+			t.Fatalf("%s = %q, %v, expected %q", key, val, err, value)
+		}
+	}
+	set(src, "a", "1")
+	set(src, "b", "1")
+	push("first")
+	if err := dst.Pull(remote); err != nil {
+		t.Fatal(err)
+	}
+	// Changes to different keys are merged
+	set(src, "a", "2")
+	push("src")
+	set(dst, "b", "2")
+	set(dst, "c", "2")
+	if err := dst.Pull(remote); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Head().Equal(src.Head()) {
+		t.Fatalf("pulled %v, expected %v", dst.Head(), src.Head())
+	}
+	expect("a", "2")
+	expect("b", "2")
+	expect("c", "2")
+	// Conflicting changes fail the merge by default
+	set(src, "a", "src")
+	push("conflict")
+	set(dst, "a", "dst")
+	var mergeErr *MergeError
+	if err := dst.Pull(remote); !errors.Is(err, ErrConflict) || !errors.As(err, &mergeErr) {
+		t.Fatalf("expected a MergeError, got %v", err)
+	}
+	if len(mergeErr.Conflicts) != 1 || mergeErr.Conflicts[0].Key != "a" {
+		t.Fatalf("conflicts: %v", mergeErr.Conflicts)
+	}
+	expect("a", "dst")
+	// The reference moved, but db didn't: it can't commit until the
+	// merge is completed by pulling again.
+	if err := dst.Commit("stale"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("commit after a failed merge: expected ErrConflict, got %v", err)
+	}
+	dst.SetMergeStrategy(MergeOurs)
+	if err := dst.Pull(remote); err != nil {
+		t.Fatal(err)
+	}
+	expect("a", "dst")
+	expect("b", "2")
+	if err := dst.Commit("merged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if dst.commit.ParentCount() != 1 || !dst.commit.ParentId(0).Equal(src.Head()) {
+		t.Fatalf("the merge should be committed on top of %v", src.Head())
+	}
+}
@@ -3,10 +3,15 @@ package libpack
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 
 	git "github.com/libgit2/git2go"
 
@@ -16,66 +21,833 @@ import (
 const (
 	MetaTree = "_fs_meta"
 	DataTree = "_fs_data"
+	AttrTree = "_fs_attr"
 )
 
 // GetTar generates a tar stream frmo the contents of db, and streams
 // it to `dst`.
+// Entries are written in the order in which SetTar imported them.
+// Entries without a recorded position (for example written by older
+// versions) are written afterwards in path order, with hardlinks last
+// so that they always follow their target.
+// Sparse files are written as regular files, with their holes filled
+// with zeroes.
 func (db *DB) GetTar(dst io.Writer) error {
+	return db.GetTarWithOptions(dst, nil)
+}
+
+// GetTarWithOptions is like GetTar, with additional options.
+// Options which only apply to imports are ignored.
+// A nil `opts` is equivalent to the default options.
+func (db *DB) GetTarWithOptions(dst io.Writer, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+	if db.Latest() == nil {
+		return fmt.Errorf("no tree to export")
+	}
+	entries, err := db.tarEntries()
+	if err != nil {
+		return err
+	}
 	tw := tar.NewWriter(dst)
 	defer tw.Close()
-	// Walk the data tree
-	return db.Walk(DataTree, func(name string, obj git.Object) error {
-		fmt.Fprintf(os.Stderr, "Generating tar entry for '%s'...\n", name)
-		metaBlob, err := db.Get(metaPath(name))
-		if err != nil {
+	progress := ProgressEvent{TotalFiles: len(entries)}
+	for _, entry := range entries {
+		// Write the reconstituted tar header+content
+		if err := tw.WriteHeader(entry.hdr); err != nil {
 			return err
 		}
-		tr := tar.NewReader(bytes.NewReader([]byte(metaBlob)))
-		hdr, err := tr.Next()
-		if err != nil {
-			return err
+		if entry.blob != nil {
+			db.debugf("--> writing %d bytes for blob %s", entry.hdr.Size, entry.hdr.Name)
+			if err := db.copyBlob(tw, entry.blob, entry.hdr.Size); err != nil {
+				return fmt.Errorf("%s: %v", entry.hdr.Name, err)
+			}
+			progress.Bytes += entry.hdr.Size
+		} else if entry.chunks != nil {
+			db.debugf("--> writing %d bytes in %d chunks for %s", entry.hdr.Size, len(entry.chunks), entry.hdr.Name)
+			if err := db.copyChunks(tw, entry.chunks, entry.hdr.Size); err != nil {
+				return fmt.Errorf("%s: %v", entry.hdr.Name, err)
+			}
+			progress.Bytes += entry.hdr.Size
 		}
-		// Write the reconstituted tar header+content
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
+		if opts.Progress != nil {
+			progress.Name = entry.hdr.Name
+			progress.Files++
+			opts.Progress(progress)
 		}
-		if blob, isBlob := obj.(*git.Blob); isBlob {
-			fmt.Fprintf(os.Stderr, "--> writing %d bytes for blob %s\n", hdr.Size, hdr.Name)
-			if _, err := tw.Write(blob.Contents()[:hdr.Size]); err != nil {
+	}
+	return nil
+}
+
+// TarHeaders returns the headers of the entries which GetTar would
+// write, in the same order, without reading any file contents.
+func (db *DB) TarHeaders() ([]*tar.Header, error) {
+	if db.Latest() == nil {
+		return nil, fmt.Errorf("no tree to export")
+	}
+	entries, err := db.tarEntries()
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]*tar.Header, 0, len(entries))
+	for _, entry := range entries {
+		headers = append(headers, entry.hdr)
+	}
+	return headers, nil
+}
+
+// tarEntries collects the entries of the tar stream stored in db,
+// in the order in which they should be written.
+func (db *DB) tarEntries() (exportEntries, error) {
+	view, release, err := db.tarView()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var entries exportEntries
+	seen := make(map[string]bool)
+	// Walk the data tree
+	if _, err := view.entry(DataTree); err == nil {
+		err := view.Walk(DataTree, func(key string, obj git.Object) error {
+			name, err := dataName(key)
+			if err != nil {
 				return err
 			}
+			view.debugf("Generating tar entry for '%s'...", name)
+			metaBlob, err := view.getMeta(name)
+			if err != nil {
+				if _, isTree := obj.(*git.Tree); isTree {
+					// The directory was not in the archive, only
+					// its contents.
+					return nil
+				}
+				return err
+			}
+			entry, err := view.exportEntry(name, metaBlob, path.Join(DataTree, key), obj)
+			if err != nil {
+				return err
+			}
+			seen[TreePath(name)] = true
+			entries = append(entries, entry)
+			if _, isTree := obj.(*git.Tree); isTree && entry.hdr.Typeflag != tar.TypeDir {
+				// The chunks of a file are not entries of their own
+				return SkipTree
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Entries without data, such as empty directories, devices and
+	// fifos, are only found in the metadata tree.
+	err = view.walkAnnotations(MetaTree, func(name string, blob *git.Blob) error {
+		if seen[name] {
+			return nil
 		}
+		entry, err := view.exportEntry(name, string(blob.Contents()), "", nil)
+		if err != nil {
+			return err
+		}
+		if entry.hdr.Typeflag == tar.TypeReg || entry.hdr.Typeflag == tar.TypeRegA {
+			return fmt.Errorf("%s: no data", name)
+		}
+		entries = append(entries, entry)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(entries)
+	return entries, nil
+}
+
+// exportEntry decodes the metadata `metaBlob` stored for `name`, and
+// returns the corresponding entry of the tar stream.
+// `obj` is the object stored for `name` in the data tree, if any, and
+// `key` the key at which it was found.
+func (db *DB) exportEntry(name, metaBlob, key string, obj git.Object) (*exportEntry, error) {
+	hdr, err := decodeHeader(metaBlob)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if TreePath(hdr.Name) != TreePath(name) {
+		return nil, fmt.Errorf("%s: metadata describes %s", name, hdr.Name)
+	}
+	// The executable bit of the data entry takes precedence
+	// over the stored header.
+	if obj != nil && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+		e, err := db.entry(key)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Filemode {
+		case 0100755:
+			if hdr.Mode&0111 == 0 {
+				hdr.Mode |= 0111
+			}
+		case 0100644:
+			hdr.Mode &^= 0111
+		}
+	}
+	entry := &exportEntry{hdr: hdr, seq: -1}
+	if seq, err := db.Get(attrPath(name, "seq")); err == nil {
+		if entry.seq, err = strconv.Atoi(seq); err != nil {
+			return nil, fmt.Errorf("%s: invalid sequence number: %v", name, err)
+		}
+	}
+	// Symlinks are stored as blobs too, but their content is
+	// the link target which is already in the header.
+	// Hardlinks point to the same blob as their target, and
+	// have no content of their own.
+	if _, isBlob := obj.(*git.Blob); isBlob && hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+		entry.blob = obj.Id()
+	}
+	if tree, isTree := obj.(*git.Tree); isTree && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+		if entry.chunks, err = db.chunks(name, tree); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return entry, nil
+}
+
+// copyBlob streams the contents of the blob `id` to `dst`, and returns
+// an error if it is not exactly `size` bytes long.
+func (db *DB) copyBlob(dst io.Writer, id *git.Oid, size int64) error {
+	src, err := db.openBlob(id)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	n, err := io.CopyN(dst, src, size)
+	if err == io.EOF {
+		return fmt.Errorf("blob %v is %d bytes, expected %d", id, n, size)
+	} else if err != nil {
+		return err
+	}
+	if n, _ := src.Read(make([]byte, 1)); n != 0 {
+		return fmt.Errorf("blob %v is larger than the expected %d bytes", id, size)
+	}
 	return nil
 }
 
+// openBlob returns a reader for the contents of the blob `id`.
+// If the object database supports it, the contents are streamed from it.
+// Otherwise the blob is loaded in memory.
+func (db *DB) openBlob(id *git.Oid) (io.ReadCloser, error) {
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := odb.NewReadStream(id)
+	if err == nil {
+		return &odbReader{odb, stream}, nil
+	}
+	odb.Free()
+	blob, err := db.lookupBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Free()
+	return ioutil.NopCloser(bytes.NewReader(blob.Contents())), nil
+}
+
+// odbReader reads an object from an object database stream, and frees
+// both when closed.
+type odbReader struct {
+	odb    *git.Odb
+	stream *git.OdbReadStream
+}
+
+func (r *odbReader) Read(p []byte) (int, error) {
+	return r.stream.Read(p)
+}
+
+func (r *odbReader) Close() error {
+	err := r.stream.Close()
+	r.stream.Free()
+	r.odb.Free()
+	return err
+}
+
+// exportEntry is an entry of a tar stream being generated by GetTar.
+type exportEntry struct {
+	hdr    *tar.Header
+	blob   *git.Oid   // the data to write after the header, if any
+	chunks []*git.Oid // or the chunks of the data, for a chunked file
+	seq    int        // position in the original archive, or -1 if unknown
+}
+
+// exportEntries sorts entries in the order in which they should be
+// written to a tar stream.
+type exportEntries []*exportEntry
+
+func (entries exportEntries) Len() int      { return len(entries) }
+func (entries exportEntries) Swap(i, j int) { entries[i], entries[j] = entries[j], entries[i] }
+func (entries exportEntries) Less(i, j int) bool {
+	ri, rj := entries[i].rank(), entries[j].rank()
+	if ri != rj {
+		return ri < rj
+	}
+	return ri == 0 && entries[i].seq < entries[j].seq
+}
+
+// rank groups entries which can be compared: entries with a known
+// position come first, then all others except hardlinks, then hardlinks.
+func (e *exportEntry) rank() int {
+	if e.seq >= 0 {
+		return 0
+	}
+	if e.hdr.Typeflag == tar.TypeLink {
+		return 2
+	}
+	return 1
+}
+
 // SetTar adds data to db from a tar strema decoded from `src`.
-// Raw data is stored at the key `_fs_data/', and metadata in a
-// separate key '_fs_metadata'.
+// Raw data is stored at the key `_fs_data/', metadata in a
+// separate key '_fs_meta', and other attributes of each entry
+// in '_fs_attr'. Each component of the entry names is escaped with
+// EscapeKey, so that for example "app/.git/config" is stored at
+// "_fs_data/app/%2Egit/config". Imports stored by older versions,
+// whose names are not escaped, are converted first.
 func (db *DB) SetTar(src io.Reader) error {
+	_, err := db.SetTarWithOptions(src, nil)
+	return err
+}
+
+// ImportTar adds data to db from the tar stream `src` like SetTar,
+// and commits the result with the message `msg`.
+func (db *DB) ImportTar(src io.Reader, msg string) error {
+	if err := db.SetTar(src); err != nil {
+		return err
+	}
+	return db.Commit(msg)
+}
+
+// ApplyTarLayer applies the tar stream `src` as a layer on top of the
+// uncommitted tree of db, with whiteouts (see TarOptions), and returns
+// the id of the resulting tree. Nothing is committed.
+func (db *DB) ApplyTarLayer(src io.Reader) (*git.Oid, error) {
+	if _, err := db.SetTarWithOptions(src, &TarOptions{ApplyWhiteouts: true}); err != nil {
+		return nil, err
+	}
+	return db.Latest(), nil
+}
+
+// ImportTarLayer applies the tar stream `src` as a layer on top of the
+// commit `parent`, and commits the result with the message `msg` in a
+// single commit. The id of the new commit is returned.
+// `parent` must be the current head of the database's reference ("" if
+// it has no commits yet), and there must be no uncommitted changes:
+// otherwise an error is returned and nothing is imported.
+// This allows reconstructing a history of image layers as a chain of
+// commits.
+func (db *DB) ImportTarLayer(src io.Reader, parent, msg string) (*git.Oid, error) {
+	if err := db.Update(); err != nil {
+		return nil, err
+	}
+	var head string
+	if db.Head() != nil {
+		head = db.Head().String()
+	}
+	if head != parent {
+		return nil, fmt.Errorf("%s is at %q, not %q: %w", db.ref, head, parent, ErrConflict)
+	}
+	root := db.root()
+	root.mu.RLock()
+	dirty, err := root.uncommitted()
+	root.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	} else if dirty {
+		return nil, fmt.Errorf("uncommitted changes")
+	}
+	if _, err := db.ApplyTarLayer(src); err != nil {
+		return nil, err
+	}
+	if err := db.Commit(msg); err != nil {
+		return nil, err
+	}
+	return db.Head(), nil
+}
+
+// Tar2git imports the tar stream `src` into the git repository at
+// `repo`, and returns the hash of the resulting tree.
+// If `branch` is not empty, the tree is committed to that reference,
+// on top of its current contents. Otherwise it is imported into an
+// empty tree and not committed.
+// If `scope` is not empty, the tar stream is stored in the subtree at
+// `scope` instead of the root of the tree.
+func Tar2git(src io.Reader, repo, branch, scope string) (string, error) {
+	if branch != "" && !strings.HasPrefix(branch, "refs/") {
+		return "", fmt.Errorf("%s: invalid reference name", branch)
+	}
+	db, err := Init(repo, branch, scope)
+	if err != nil {
+		return "", err
+	}
+	defer db.Free()
+	if branch == "" {
+		if err := db.SetTar(src); err != nil {
+			return "", err
+		}
+	} else {
+		if err := db.ImportTar(src, "imported tar filesystem tree"); err != nil {
+			return "", err
+		}
+	}
+	id := db.Latest()
+	if id == nil {
+		// The archive was empty
+		if id, err = emptyTree(db.repo); err != nil {
+			return "", err
+		}
+	}
+	return id.String(), nil
+}
+
+// Git2tar exports the tree designated by `name` in the git repository
+// at `repo` as a tar stream, and streams it to `dst`. `name` and `scope`
+// are resolved by ResolveTree, so that a tar stream imported with the
+// same scope can be exported again.
+func Git2tar(repo, name, scope string, dst io.Writer) error {
+	db, err := OpenTree(repo, name, scope)
+	if err != nil {
+		return err
+	}
+	defer db.Free()
+	return db.GetTar(dst)
+}
+
+// OpenTree returns a database holding the tree designated by `name` in
+// the git repository at `repo`. `name` and `scope` are resolved by
+// ResolveTree. The database has no reference: it is meant to be read,
+// for example with List, GetTar or ValidateTarTree, and not committed.
+func OpenTree(repo, name, scope string) (*DB, error) {
+	r, err := git.OpenRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := ResolveTree(r, name, scope)
+	if err != nil {
+		r.Free()
+		return nil, err
+	}
+	return &DB{repo: r, tree: tree}, nil
+}
+
+// ResolveTree returns the tree designated by `name` in the repository
+// `r`: the name of a reference (for example "refs/heads/foo" or "foo"),
+// or the hash of a commit or tree, which may be abbreviated.
+// If `scope` is not empty, the subtree at `scope` is returned instead.
+// The caller must free the returned tree.
+func ResolveTree(r *git.Repository, name, scope string) (*git.Tree, error) {
+	scope, err := scopedPath("", scope)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := r.RevparseSingle(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such reference, commit or tree: %w", name, ErrNotExist)
+	}
+	var tree *git.Tree
+	switch o := obj.(type) {
+	case *git.Commit:
+		tree, err = o.Tree()
+		o.Free()
+		if err != nil {
+			return nil, err
+		}
+	case *git.Tree:
+		tree = o
+	default:
+		obj.Free()
+		return nil, fmt.Errorf("%s: not a commit or tree", name)
+	}
+	if scope == "/" {
+		return tree, nil
+	}
+	defer tree.Free()
+	subtree, err := lookupSubtree(r, tree, scope)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", name, scope, err)
+	}
+	return subtree, nil
+}
+
+// TarOptions configures how SetTarWithOptions imports a tar stream.
+type TarOptions struct {
+	// ApplyWhiteouts treats the tar stream as a layer to apply on top
+	// of the current contents of db: instead of being stored, AUFS
+	// whiteout files (".wh.NAME") delete NAME, and opaque directory
+	// markers (".wh..wh..opq") clear the contents of their directory.
+	// An opaque marker must precede the directory's new content in
+	// the stream, as it does in archives produced by docker.
+	ApplyWhiteouts bool
+
+	// ChunkThreshold, if positive, stores regular files larger than
+	// ChunkThreshold bytes in content-defined chunks, so that the
+	// unchanged regions of a file modified between imports are not
+	// stored again. Chunked files are exported transparently.
+	ChunkThreshold int64
+
+	// Progress, if set, is called after each entry of the tar stream
+	// is processed.
+	Progress func(ProgressEvent)
+}
+
+// ProgressEvent reports the progress of a tar import or export.
+type ProgressEvent struct {
+	Name       string // name of the last entry processed
+	Bytes      int64  // bytes of content processed so far
+	Files      int    // entries processed so far
+	TotalFiles int    // total number of entries, or 0 if unknown
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// ImportStats reports how much of a tar import was already stored.
+type ImportStats struct {
+	Files        int   // regular files imported
+	Bytes        int64 // content of the regular files, in bytes
+	NewBlobs     int   // blobs which had to be written
+	BytesWritten int64 // content of the new blobs, in bytes
+	ReusedBlobs  int   // blobs which were already stored
+}
+
+// dedupMaxSize is the size above which the contents of files are not
+// loaded in memory: they are hashed while streamed, and only written to
+// the object database if they are not stored already.
+const dedupMaxSize = 1 << 20
+
+// SetTarWithOptions is like SetTar, with additional options.
+// A nil `opts` is equivalent to the default options.
+func (db *DB) SetTarWithOptions(src io.Reader, opts *TarOptions) (*ImportStats, error) {
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+	if err := db.upgradeTarLayout(); err != nil {
+		return nil, err
+	}
+	stats := &ImportStats{}
+	seq, err := db.nextSeq()
+	if err != nil {
+		return nil, err
+	}
+	var progress ProgressEvent
 	tr := tar.NewReader(src)
-	for {
+	for ; ; seq++ {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
+			return nil, err
+		}
+		if dir, base := path.Split(TreePath(hdr.Name)); opts.ApplyWhiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+			if base == whiteoutOpaque {
+				err = db.clearEntry(dir)
+			} else {
+				err = db.deleteEntry(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("whiteout %s: %v", hdr.Name, err)
+			}
+			continue
+		}
+		if err := db.storeHeader(hdr, seq); err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if opts.ChunkThreshold > 0 && hdr.Size > opts.ChunkThreshold {
+				if err := db.storeChunked(hdr.Name, tr, hdr.Size, stats); err != nil {
+					return nil, err
+				}
+				break
+			}
+			id, err := db.storeBlob(tr, hdr.Size, stats)
+			if err != nil {
+				return nil, err
+			}
+			if err := db.setId(dataPath(hdr.Name), id, fileMode(hdr)); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			// Git carries symlinks natively: the blob holds the
+			// link target, and the tree entry has the symlink mode.
+			if err := db.SetLink(dataPath(hdr.Name), hdr.Linkname); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			// The target was stored earlier in the archive: point
+			// the link at the same blob instead of storing it twice.
+			e, err := db.entry(dataPath(hdr.Linkname))
+			if err != nil {
+				return nil, fmt.Errorf("hardlink %s: target %s: %v", hdr.Name, hdr.Linkname, err)
+			}
+			if err := db.setId(dataPath(hdr.Name), e.Id, e.Filemode); err != nil {
+				return nil, err
+			}
+		}
+		db.debugf("stored %s (%d bytes)", hdr.Name, hdr.Size)
+		if opts.Progress != nil {
+			progress.Name = hdr.Name
+			progress.Bytes += hdr.Size
+			progress.Files++
+			opts.Progress(progress)
+		}
+	}
+	if err := db.Set(attrPath("/", "nextseq"), strconv.Itoa(seq)); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// nextSeq returns the sequence number of the next entry to import.
+// Numbering continues after the entries of previous imports, so that
+// a layer is exported after the content it applies to.
+func (db *DB) nextSeq() (int, error) {
+	next, err := db.Get(attrPath("/", "nextseq"))
+	if err != nil {
+		return 0, nil
+	}
+	seq, err := strconv.Atoi(next)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sequence number: %v", err)
+	}
+	return seq, nil
+}
+
+// storeHeader stores the metadata of the tar entry `hdr`, which is the
+// entry number `seq` of the archive.
+// GNU sparse entries are converted to regular files in place.
+func (db *DB) storeHeader(hdr *tar.Header, seq int) error {
+	// The sparse map of a GNU sparse file can't be encoded again:
+	// store the file expanded, as a regular file (git compresses
+	// the holes anyway), and flag it with the "sparse" attribute.
+	sparse := hdr.Typeflag == tar.TypeGNUSparse
+	if sparse {
+		hdr.Typeflag = tar.TypeReg
+	}
+	// Drop the attributes of a previous version of the entry
+	if err := db.Delete(path.Join(AttrTree, MkAnnotation(hdr.Name))); err != nil {
+		return err
+	}
+	if TreePath(hdr.Name) == "/" {
+		// The attributes of the root are also those of the whole
+		// import: the names stay escaped, and the callers write
+		// nextseq once done.
+		if err := db.Set(attrPath("/", escapedAttr), "1"); err != nil {
 			return err
 		}
-		fmt.Printf("[META] %s\n", hdr.Name)
-		metaBlob, err := headerReader(hdr)
-		if err != nil {
+	}
+	metaBlob, err := headerReader(hdr)
+	if err != nil {
+		return err
+	}
+	if err := db.SetStream(metaPath(hdr.Name), metaBlob); err != nil {
+		return err
+	}
+	// Record the position of the entry, so that GetTar can
+	// reproduce the original order.
+	if err := db.Set(attrPath(hdr.Name, "seq"), strconv.Itoa(seq)); err != nil {
+		return err
+	}
+	if sparse {
+		if err := db.Set(attrPath(hdr.Name, "sparse"), "gnu"); err != nil {
 			return err
 		}
-		fmt.Printf("    ---> storing metadata in %s\n", metaPath(hdr.Name))
-		if err := db.SetStream(metaPath(hdr.Name), metaBlob); err != nil {
+	}
+	return nil
+}
+
+// fileMode returns the git filemode under which the content of the
+// regular file `hdr` is stored. Like git itself, only the executable
+// bit is recorded on the tree entry: the full mode and ownership stay
+// in the metadata.
+func fileMode(hdr *tar.Header) int {
+	return gitFileMode(os.FileMode(hdr.Mode).Perm())
+}
+
+// storeBlob stores the `size` bytes of content of a regular file read
+// from `src`, and records in `stats` whether it was already stored.
+// If `src` ends before, an error is returned.
+// The tree is not changed, so storeBlob may be called concurrently
+// with distinct `stats`.
+func (db *DB) storeBlob(src io.Reader, size int64, stats *ImportStats) (*git.Oid, error) {
+	stats.Files++
+	stats.Bytes += size
+	if size > dedupMaxSize {
+		return db.storeLargeBlob(src, size, stats)
+	}
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("read %d bytes, expected %d", len(data), size)
+	}
+	return db.storeBytes(data, stats)
+}
+
+// storeLargeBlob is storeBlob for contents too large to be loaded in
+// memory. The content is hashed first, to check whether it is already
+// stored, then read again to be written if it is not. Sources which
+// can't be read twice are copied to a temporary file while hashed.
+func (db *DB) storeLargeBlob(src io.Reader, size int64, stats *ImportStats) (*git.Oid, error) {
+	var (
+		id    *git.Oid
+		err   error
+		start int64
+	)
+	rs, seekable := src.(io.ReadSeeker)
+	if seekable {
+		if start, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		id, err = hashBlob(rs, size)
+	} else {
+		var tmp *os.File
+		if tmp, err = ioutil.TempFile("", "libpack-blob-"); err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		id, err = hashBlob(io.TeeReader(src, tmp), size)
+		rs = tmp
+	}
+	if err != nil {
+		return nil, err
+	}
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	exists := odb.Exists(id)
+	odb.Free()
+	if exists {
+		stats.ReusedBlobs++
+		return id, nil
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	written, err := db.createBlobStream(io.LimitReader(rs, size))
+	if err != nil {
+		return nil, err
+	}
+	if !written.Equal(id) {
+		return nil, fmt.Errorf("content changed while read")
+	}
+	stats.NewBlobs++
+	stats.BytesWritten += size
+	return id, nil
+}
+
+// hashBlob returns the id of a blob holding the `size` bytes read from
+// `src`, without storing it.
+func hashBlob(src io.Reader, size int64) (*git.Oid, error) {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", size)
+	n, err := io.Copy(h, src)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("read %d bytes, expected %d", n, size)
+	}
+	return git.NewOidFromBytes(h.Sum(nil)), nil
+}
+
+// storeBytes stores `data` in a blob, unless it is already stored, and
+// records in `stats` which was the case.
+func (db *DB) storeBytes(data []byte, stats *ImportStats) (*git.Oid, error) {
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+	var id *git.Oid
+	if len(data) == 0 {
+		id, err = git.NewOid(emptyBlobId)
+	} else {
+		id, err = odb.Hash(data, git.ObjectBlob)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if odb.Exists(id) {
+		stats.ReusedBlobs++
+		return id, nil
+	}
+	stats.NewBlobs++
+	stats.BytesWritten += int64(len(data))
+	return db.createBlob(string(data))
+}
+
+// add adds the counters of `other` to `stats`.
+func (stats *ImportStats) add(other *ImportStats) {
+	stats.Files += other.Files
+	stats.Bytes += other.Bytes
+	stats.NewBlobs += other.NewBlobs
+	stats.BytesWritten += other.BytesWritten
+	stats.ReusedBlobs += other.ReusedBlobs
+}
+
+// deleteEntry removes the data, metadata and attributes stored for
+// `name` and everything below it.
+func (db *DB) deleteEntry(name string) error {
+	if err := db.Delete(dataPath(name)); err != nil {
+		return err
+	}
+	for _, annotations := range []string{MetaTree, AttrTree} {
+		if err := db.Delete(path.Join(annotations, MkAnnotation(name))); err != nil {
 			return err
 		}
-		// FIXME: git can carry symlinks as well
-		if hdr.Typeflag == tar.TypeReg {
-			fmt.Printf("[DATA] %s %d bytes\n", hdr.Name, hdr.Size)
-			if err := db.SetStream(path.Join("_fs_data", hdr.Name), tr); err != nil {
+	}
+	return db.clearAnnotations(name)
+}
+
+// clearEntry removes the data, metadata and attributes stored for
+// everything below the directory `name`, but not for `name` itself.
+func (db *DB) clearEntry(name string) error {
+	if err := db.Delete(dataPath(name)); err != nil {
+		return err
+	}
+	if err := db.Mkdir(dataPath(name)); err != nil {
+		return err
+	}
+	return db.clearAnnotations(name)
+}
+
+// clearAnnotations removes the metadata and attributes stored for
+// everything below `name`. Since they are stored by depth, this means
+// removing `name` in every depth-level greater than its own.
+func (db *DB) clearAnnotations(name string) error {
+	name = TreePath(name)
+	depth := 0
+	if name != "/" {
+		depth = len(strings.Split(name, "/"))
+	}
+	// The target is stored escaped at each level, as by MkAnnotation
+	escaped := escapePath(name)
+	for _, annotations := range []string{MetaTree, AttrTree} {
+		levels, err := db.List(annotations)
+		if err != nil {
+			// No annotations at all
+			continue
+		}
+		for _, level := range levels {
+			if l, err := strconv.Atoi(level); err != nil || l <= depth {
+				continue
+			}
+			if err := db.Delete(path.Join(annotations, level, escaped)); err != nil {
 				return err
 			}
 		}
@@ -83,17 +855,214 @@ func (db *DB) SetTar(src io.Reader) error {
 	return nil
 }
 
+// dataPath returns the key at which the data of the entry `name` is
+// stored, for example "_fs_data/etc/resolv.conf". Each component of the
+// name is escaped with EscapeKey, so that entries such as
+// "src/.git/config" can be stored.
+func dataPath(name string) string {
+	return path.Join(DataTree, escapePath(name))
+}
+
+// dataName returns the name of the entry whose data is stored at `key`,
+// relative to DataTree, in the format returned by TreePath. It is the
+// reverse of dataPath.
+func dataName(key string) (string, error) {
+	key = TreePath(key)
+	if key == "/" {
+		return key, nil
+	}
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		name, err := UnescapeKey(part)
+		if err != nil || name == "" || strings.Contains(name, "/") {
+			return "", fmt.Errorf("%s: invalid name in the data tree", key)
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// escapedAttr is the attribute of the root which marks the names of a
+// tar import as escaped, by dataPath and MkAnnotation. Older versions
+// stored names as is, and did not set it.
+const escapedAttr = "escaped"
+
+// escapedNames returns true if the names of the tar import stored in db
+// are escaped.
+func (db *DB) escapedNames() bool {
+	_, err := db.Get(attrPath("/", escapedAttr))
+	return err == nil
+}
+
+// upgradeTarLayout escapes the names of the tar import stored in db, if
+// it was stored by an older version, and marks them as escaped. It must
+// be called before storing anything at a key returned by dataPath,
+// metaPath or attrPath.
+func (db *DB) upgradeTarLayout() error {
+	if db.escapedNames() {
+		return nil
+	}
+	for _, key := range []string{DataTree, MetaTree, AttrTree} {
+		e, err := db.entry(key)
+		if errors.Is(err, ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		tree, err := lookupTree(db.repo, e.Id)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		id, err := escapeTree(db.repo, tree)
+		tree.Free()
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		// Setting a tree merges it with the existing one
+		if err := db.Delete(key); err != nil {
+			return err
+		}
+		if err := db.setId(key, id, 040000); err != nil {
+			return err
+		}
+	}
+	return db.Set(attrPath("/", escapedAttr), "1")
+}
+
+// escapeTree writes a copy of `tree` in which the name of every entry,
+// at any depth, is escaped with EscapeKey, and returns its id.
+// The chunks of a file and the depth levels of annotations have names
+// which EscapeKey leaves unchanged.
+func escapeTree(repo *git.Repository, tree *git.Tree) (*git.Oid, error) {
+	builder, err := repo.TreeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		e := tree.EntryByIndex(i)
+		id := e.Id
+		if e.Type == git.ObjectTree {
+			subtree, err := lookupTree(repo, e.Id)
+			if err != nil {
+				return nil, err
+			}
+			id, err = escapeTree(repo, subtree)
+			subtree.Free()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := builder.Insert(EscapeKey(e.Name), id, e.Filemode); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Write()
+}
+
+// tarView returns a database holding the tar import stored in db, with
+// escaped names. If db was stored by an older version, its names are
+// escaped in a copy of its tree, and db itself is not changed.
+// `release` must be called once the view is no longer used.
+func (db *DB) tarView() (view *DB, release func(), err error) {
+	if db.escapedNames() {
+		return db, func() {}, nil
+	}
+	p, err := db.fullPath("/")
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := db.currentSubtree(p)
+	if err != nil {
+		return nil, nil, err
+	} else if tree == nil {
+		return db, func() {}, nil
+	}
+	// Not created with newRepo: the view must not free the repository
+	// of db, only its own trees.
+	view = &DB{repo: db.repo, tree: tree, logger: db.root().logger}
+	release = func() { view.setTree(nil) }
+	if err := view.upgradeTarLayout(); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return view, release, nil
+}
+
+// ListTar returns the names of the entries stored by SetTar in the
+// directory `dir` of the archive, sorted. If there is no such
+// directory, ErrNotExist is returned.
+func (db *DB) ListTar(dir string) ([]string, error) {
+	view, release, err := db.tarView()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	names, err := view.List(dataPath(dir))
+	if errors.Is(err, ErrNotExist) {
+		return nil, notExist(dir)
+	} else if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		if names[i], err = UnescapeKey(name); err != nil {
+			return nil, fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+	// Escaping changes the order of some names
+	sort.Strings(names)
+	return names, nil
+}
+
 // metaPath computes a path at which the metadata can be stored for a given path.
 // For example if `name` is "/etc/resolv.conf", the corresponding metapath is
-// "_fs_meta/194c1cbe5a8cfcb85c6a46b936da12ffdc32f90f"
+// "_fs_meta/2/etc/resolv.conf" (see MkAnnotation).
 // This path will be used to store and retrieve the tar header encoding the metadata
 // for the corresponding file.
 func metaPath(name string) string {
+	return path.Join(MetaTree, MkAnnotation(name))
+}
+
+// attrPath computes a path at which the attribute `attr` (for example
+// "seq") can be stored for a given path, for example
+// "_fs_attr/2/etc/resolv.conf/seq".
+// Attributes hold information about the entry which the tar header
+// cannot carry.
+func attrPath(name, attr string) string {
+	return path.Join(AttrTree, MkAnnotation(name), attr)
+}
+
+// legacyMetaPath computes the path at which older versions stored the
+// metadata for a given path, for example
+// "_fs_meta/194c1cbe5a8cfcb85c6a46b936da12ffdc32f90f".
+func legacyMetaPath(name string) string {
 	name = path.Clean(name)
-	// FIXME: this doesn't seem to yield the expected result.
 	return path.Join(MetaTree, fmt.Sprintf("%x", sha1.Sum([]byte(name))))
 }
 
+// getMeta returns the serialized tar header stored for `name`.
+// Metadata stored by older versions at legacyMetaPath is also looked up.
+func (db *DB) getMeta(name string) (string, error) {
+	metaBlob, err := db.Get(metaPath(name))
+	if err == nil {
+		return metaBlob, nil
+	}
+	if legacyBlob, legacyErr := db.Get(legacyMetaPath(name)); legacyErr == nil {
+		return legacyBlob, nil
+	}
+	return "", err
+}
+
+// headerReader encodes the metadata of a tar entry, as a tar stream
+// holding only the header of the entry. Fields which don't fit in the
+// ustar format, such as long names and extended attributes, are encoded
+// as PAX records.
+//
+// The following fields are guaranteed to survive an headerReader /
+// decodeHeader round trip: Name and Linkname (of any length), Typeflag,
+// Mode, Uid, Gid, Uname, Gname, Size, ModTime (to the second), Devmajor,
+// Devminor and Xattrs. Sub-second times, AccessTime, ChangeTime and any
+// other PAX record are not preserved.
 func headerReader(hdr *tar.Header) (io.Reader, error) {
 	var buf bytes.Buffer
 	w := tar.NewWriter(&buf)
@@ -103,3 +1072,15 @@ func headerReader(hdr *tar.Header) (io.Reader, error) {
 	}
 	return &buf, nil
 }
+
+// decodeHeader decodes metadata encoded by headerReader.
+func decodeHeader(metaBlob string) (*tar.Header, error) {
+	tr := tar.NewReader(strings.NewReader(metaBlob))
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("no header in metadata")
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	return hdr, nil
+}
@@ -0,0 +1,990 @@
+package libpack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
+)
+
+type tarEntry struct {
+	hdr  *tar.Header
+	data string
+}
+
+// mkTar returns a tar archive containing `entries`, in order.
+func mkTar(t *testing.T, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if e.hdr.ModTime.IsZero() {
+			e.hdr.ModTime = time.Unix(1400000000, 0)
+		}
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readTar decodes all entries from the tar archive `src`.
+func readTar(t *testing.T, src []byte) []tarEntry {
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(src))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := new(bytes.Buffer)
+		if _, err := io.Copy(data, tr); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{hdr, data.String()})
+	}
+	return entries
+}
+
+// tarRoundTrip imports `src` in a fresh database, exports it again
+// and returns the entries of the exported archive.
+func tarRoundTrip(t *testing.T, src []byte) []tarEntry {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	return readTar(t, out.Bytes())
+}
+
+func assertTarEqual(t *testing.T, expected, actual []tarEntry) {
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(expected[i].hdr, actual[i].hdr) {
+			t.Fatalf("entry %d: expected header %#v, got %#v", i, expected[i].hdr, actual[i].hdr)
+		}
+		if expected[i].data != actual[i].data {
+			t.Fatalf("entry %d (%s): expected %q, got %q", i, expected[i].hdr.Name, expected[i].data, actual[i].data)
+		}
+	}
+}
+
+func TestTarSymlinks(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0777}, ""},
+		tarEntry{&tar.Header{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, "hello"},
+		tarEntry{&tar.Header{Name: "a/rel", Typeflag: tar.TypeSymlink, Linkname: "../a/file", Mode: 0777}, ""},
+	)
+	assertTarEqual(t, readTar(t, src), tarRoundTrip(t, src))
+}
+
+func TestTarModes(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755, Uid: 1, Gid: 2, Size: 4}, "\x7fELF"},
+		tarEntry{&tar.Header{Name: "secret", Typeflag: tar.TypeReg, Mode: 0600, Uid: 1000, Gid: 1000, Size: 6}, "hunter"},
+	)
+	assertTarEqual(t, readTar(t, src), tarRoundTrip(t, src))
+
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	for key, mode := range map[string]int{
+		"_fs_data/bin/tool": 0100755,
+		"_fs_data/secret":   0100644,
+	} {
+		e, err := db.tree.EntryByPath(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Filemode != mode {
+			t.Fatalf("%s: expected mode %o, got %o", key, mode, e.Filemode)
+		}
+	}
+}
+
+func TestTarHardlinks(t *testing.T) {
+	// Links sort before their target, to check that the export
+	// reorders them.
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "z", Typeflag: tar.TypeReg, Mode: 0644, Size: 11}, "hello world"},
+		tarEntry{&tar.Header{Name: "a", Typeflag: tar.TypeLink, Linkname: "z", Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "z", Mode: 0644}, ""},
+	)
+	assertTarEqual(t, readTar(t, src), tarRoundTrip(t, src))
+
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	target, err := db.tree.EntryByPath("_fs_data/z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"_fs_data/a", "_fs_data/b"} {
+		e, err := db.tree.EntryByPath(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !e.Id.Equal(target.Id) {
+			t.Fatalf("%s: expected blob %v, got %v", key, target.Id, e.Id)
+		}
+	}
+}
+
+func TestTarMetaPaths(t *testing.T) {
+	for _, names := range [][]string{
+		{"etc/resolv.conf", "/etc/resolv.conf", "./etc/resolv.conf", "etc/./resolv.conf"},
+		{"a/", "/a", "./a/."},
+	} {
+		for _, name := range names {
+			if metaPath(name) != metaPath(names[0]) {
+				t.Fatalf("metaPath(%q) = %q, expected %q", name, metaPath(name), metaPath(names[0]))
+			}
+		}
+	}
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "/abs/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "/abs/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "abs"},
+		tarEntry{&tar.Header{Name: "./dot/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "./dot/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "dot"},
+		tarEntry{&tar.Header{Name: "plain/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "plain/./file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, "plain"},
+	)
+	assertTarEqual(t, readTar(t, src), tarRoundTrip(t, src))
+}
+
+func TestTarLegacyMetaPath(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	hdr := &tar.Header{Name: "foo", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, ModTime: time.Unix(1400000000, 0)}
+	meta, err := headerReader(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetStream(legacyMetaPath("foo"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("_fs_data/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	entries := readTar(t, out.Bytes())
+	if len(entries) != 1 || entries[0].hdr.Name != "foo" || entries[0].data != "bar" {
+		t.Fatalf("%#v", entries)
+	}
+}
+
+func TestTarOrder(t *testing.T) {
+	// Not in git's sorted order, and with directories before their
+	// contents.
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "z/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "z/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "data"},
+		tarEntry{&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0755, Size: 2}, "#!"},
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0700}, ""},
+		tarEntry{&tar.Header{Name: "a/sym", Typeflag: tar.TypeSymlink, Linkname: "../z/file", Mode: 0777}, ""},
+		tarEntry{&tar.Header{Name: "a/link", Typeflag: tar.TypeLink, Linkname: "z/file", Mode: 0644}, ""},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, out.Bytes()) {
+		assertTarEqual(t, readTar(t, src), readTar(t, out.Bytes()))
+		t.Fatalf("exported archive differs from the original")
+	}
+}
+
+func TestTarSizeMismatch(t *testing.T) {
+	for _, size := range []int64{2, 10} {
+		tmp := tmpdir(t)
+		defer os.RemoveAll(tmp)
+		db, err := Init(tmp, "refs/heads/test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Free()
+		src := mkTar(t, tarEntry{&tar.Header{Name: "foo", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, "hello"})
+		if err := db.SetTar(bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		// Corrupt the size recorded in the metadata
+		hdr := &tar.Header{Name: "foo", Typeflag: tar.TypeReg, Mode: 0644, Size: size, ModTime: time.Unix(1400000000, 0)}
+		meta, err := headerReader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetStream(metaPath("foo"), meta); err != nil {
+			t.Fatal(err)
+		}
+		err = db.GetTar(ioutil.Discard)
+		if err == nil {
+			t.Fatalf("size %d: GetTar should fail", size)
+		}
+		if !strings.Contains(err.Error(), "foo: blob") {
+			t.Fatalf("size %d: wrong error: %v", size, err)
+		}
+	}
+}
+
+func TestTarWhiteouts(t *testing.T) {
+	base := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "x"},
+		tarEntry{&tar.Header{Name: "a/y", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "y"},
+		tarEntry{&tar.Header{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "b/z", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "z"},
+		tarEntry{&tar.Header{Name: "c", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "c"},
+	)
+	layer := mkTar(t,
+		tarEntry{&tar.Header{Name: ".wh.c", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "a/.wh.x", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "b/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "b/new", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "new"},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(base)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetTarWithOptions(bytes.NewReader(layer), &TarOptions{ApplyWhiteouts: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "a/x", "b/z"} {
+		if _, err := db.Get(path.Join(DataTree, name)); err == nil {
+			t.Fatalf("%s: data should be deleted", name)
+		}
+		if _, err := db.Get(metaPath(name)); err == nil {
+			t.Fatalf("%s: metadata should be deleted", name)
+		}
+	}
+	for _, name := range []string{".wh.c", "a/.wh.x", "b/.wh..wh..opq"} {
+		if _, err := db.Get(metaPath(name)); err == nil {
+			t.Fatalf("%s: whiteout should not be stored", name)
+		}
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range readTar(t, out.Bytes()) {
+		names = append(names, e.hdr.Name)
+	}
+	if fmt.Sprintf("%v", names) != "[a/ a/y b/ b/new]" {
+		t.Fatalf("%v", names)
+	}
+}
+
+// Annotations are stored under escaped names: whiteouts must remove
+// them too.
+func TestTarWhiteoutEscaped(t *testing.T) {
+	base := mkTar(t,
+		tarEntry{&tar.Header{Name: "100%/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "100%/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "x"},
+		tarEntry{&tar.Header{Name: "kept", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "k"},
+	)
+	layer := mkTar(t,
+		tarEntry{&tar.Header{Name: ".wh.100%", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(base)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetTarWithOptions(bytes.NewReader(layer), &TarOptions{ApplyWhiteouts: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"100%", "100%/x"} {
+		if _, err := db.Get(metaPath(name)); err == nil {
+			t.Fatalf("%s: metadata should be deleted", name)
+		}
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range readTar(t, out.Bytes()) {
+		names = append(names, e.hdr.Name)
+	}
+	if fmt.Sprintf("%v", names) != "[kept]" {
+		t.Fatalf("%v", names)
+	}
+}
+
+// Names which can't be stored as is in a git tree are escaped in the
+// data tree, and restored on export.
+func TestTarEscapedNames(t *testing.T) {
+	// The attributes of the root entry are replaced on import: the
+	// names must still be read back as escaped.
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "app/.git/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "app/.git/config", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "conf"},
+		tarEntry{&tar.Header{Name: "app/100%", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "full"},
+		tarEntry{&tar.Header{Name: "app/link", Typeflag: tar.TypeLink, Linkname: "app/.git/config", Mode: 0644}, ""},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.SetTar(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTarTree(db); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, out.Bytes()) {
+		assertTarEqual(t, readTar(t, src), readTar(t, out.Bytes()))
+		t.Fatalf("exported archive differs from the original")
+	}
+}
+
+// runGit runs git on the repository `repo` with the input `input`, and
+// returns its output.
+func runGit(t *testing.T, repo, input string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"--git-dir", repo}, args...)...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=libpack", "GIT_AUTHOR_EMAIL=libpack",
+		"GIT_COMMITTER_NAME=libpack", "GIT_COMMITTER_EMAIL=libpack")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitTree stores the tree `entries` in the repository `repo` with the
+// git command, which unlike libgit2 accepts entries named ".git", and
+// returns its id. Strings are stored as blobs, and maps as subtrees.
+func gitTree(t *testing.T, repo string, entries map[string]interface{}) string {
+	var input bytes.Buffer
+	for name, v := range entries {
+		switch v := v.(type) {
+		case string:
+			fmt.Fprintf(&input, "100644 blob %s\t%s\n", runGit(t, repo, v, "hash-object", "-w", "--stdin"), name)
+		case map[string]interface{}:
+			fmt.Fprintf(&input, "040000 tree %s\t%s\n", gitTree(t, repo, v), name)
+		}
+	}
+	return runGit(t, repo, input.String(), "mktree")
+}
+
+// Older versions stored names as is: names which look like escapes, or
+// which only git accepts, must be read back unchanged.
+func TestTarUnescapedLayout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	meta := func(name, data string) string {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: time.Unix(1400000000, 0)}
+		r, err := headerReader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(blob)
+	}
+	tree := gitTree(t, tmp, map[string]interface{}{
+		DataTree: map[string]interface{}{
+			"a%41": "A",
+			"vendor": map[string]interface{}{"dep": map[string]interface{}{
+				".git": map[string]interface{}{"config": "conf"},
+			}},
+		},
+		MetaTree: map[string]interface{}{
+			"1": map[string]interface{}{"a%41": meta("a%41", "A")},
+			"4": map[string]interface{}{"vendor": map[string]interface{}{"dep": map[string]interface{}{
+				".git": map[string]interface{}{"config": meta("vendor/dep/.git/config", "conf")},
+			}}},
+		},
+	})
+	commit := runGit(t, tmp, "", "commit-tree", "-m", "baseline layout", tree)
+	runGit(t, tmp, "", "update-ref", "refs/heads/test", commit)
+	if err := db.Update(); err != nil {
+		t.Fatal(err)
+	}
+	export := func() string {
+		var out bytes.Buffer
+		if err := db.GetTar(&out); err != nil {
+			t.Fatal(err)
+		}
+		var exported []string
+		for _, e := range readTar(t, out.Bytes()) {
+			exported = append(exported, e.hdr.Name+"="+e.data)
+		}
+		return fmt.Sprintf("%v", exported)
+	}
+	if exported := export(); exported != "[a%41=A vendor/dep/.git/config=conf]" {
+		t.Fatalf("%s", exported)
+	}
+	if err := ValidateTarTree(db); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := db.ListTar("vendor/dep"); err != nil || fmt.Sprintf("%v", names) != "[.git]" {
+		t.Fatalf("ListTar: %v, %v", names, err)
+	}
+	if db.Latest().String() != tree {
+		t.Fatalf("reading the tree changed it")
+	}
+	// Importing on top of it escapes the existing names first
+	layer := mkTar(t, tarEntry{&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "B"})
+	if err := db.SetTar(bytes.NewReader(layer)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get(path.Join(DataTree, "a%2541")); err != nil || value != "A" {
+		t.Fatalf("a%%41 was not escaped: %q, %v", value, err)
+	}
+	if exported := export(); exported != "[b=B a%41=A vendor/dep/.git/config=conf]" {
+		t.Fatalf("%s", exported)
+	}
+	if err := ValidateTarTree(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarProgress(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+		tarEntry{&tar.Header{Name: "y", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, "yy"},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	var events []ProgressEvent
+	opts := &TarOptions{Progress: func(e ProgressEvent) { events = append(events, e) }}
+	if _, err := db.SetTarWithOptions(bytes.NewReader(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := ProgressEvent{Name: "y", Bytes: 5, Files: 3}
+	if len(events) != 3 || events[2] != expected {
+		t.Fatalf("import: %#v", events)
+	}
+	events = nil
+	if err := db.GetTarWithOptions(ioutil.Discard, opts); err != nil {
+		t.Fatal(err)
+	}
+	expected.TotalFiles = 3
+	if len(events) != 3 || events[2] != expected {
+		t.Fatalf("export: %#v", events)
+	}
+}
+
+func TestTarLongNamesAndXattrs(t *testing.T) {
+	long := strings.Repeat("long-directory-name/", 8)
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: long, Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: long + "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "long"},
+		tarEntry{&tar.Header{
+			Name:     "ping",
+			Typeflag: tar.TypeReg,
+			Mode:     0755,
+			Size:     4,
+			Xattrs:   map[string]string{"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00"},
+		}, "ping"},
+	)
+	entries := tarRoundTrip(t, src)
+	assertTarEqual(t, readTar(t, src), entries)
+	if len(entries[1].hdr.Name) <= 100 {
+		t.Fatalf("name was truncated: %s", entries[1].hdr.Name)
+	}
+	if entries[2].hdr.Xattrs["security.capability"] != "\x01\x00\x00\x02\x00\x20\x00\x00" {
+		t.Fatalf("xattrs were lost: %#v", entries[2].hdr.Xattrs)
+	}
+}
+
+func TestTarImportStats(t *testing.T) {
+	// Larger than dedupMaxSize, so that it is not loaded in memory
+	big := strings.Repeat("b", dedupMaxSize+1)
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+		tarEntry{&tar.Header{Name: "a/copy", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+		tarEntry{&tar.Header{Name: "y", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, "yy"},
+		tarEntry{&tar.Header{Name: "empty", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(big))}, big},
+		tarEntry{&tar.Header{Name: "big2", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(big))}, big},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	stats, err := db.SetTarWithOptions(bytes.NewReader(src), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(big))
+	expected := ImportStats{Files: 6, Bytes: 8 + 2*size, NewBlobs: 4, BytesWritten: 5 + size, ReusedBlobs: 2}
+	if *stats != expected {
+		t.Fatalf("first import: %#v", stats)
+	}
+	if value, err := db.Get(path.Join(DataTree, "big")); err != nil || value != big {
+		t.Fatalf("big: %d bytes, %v", len(value), err)
+	}
+	stats, err = db.SetTarWithOptions(bytes.NewReader(src), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = ImportStats{Files: 6, Bytes: 8 + 2*size, ReusedBlobs: 6}
+	if *stats != expected {
+		t.Fatalf("second import: %#v", stats)
+	}
+	// Files are read twice instead of being copied
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "big"), []byte(big), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = db.SetDir(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stats.NewBlobs != 0 || stats.ReusedBlobs != 1 {
+		t.Fatalf("SetDir: %#v", stats)
+	}
+}
+
+func TestTar2git2tar(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	for _, branch := range []string{"", "refs/heads/test"} {
+		hash, err := Tar2git(bytes.NewReader(src), tmp, branch, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := Git2tar(tmp, hash, "", &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(src, out.Bytes()) {
+			t.Fatalf("branch %q: exported archive differs from the original", branch)
+		}
+	}
+	db, err := Open(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if db.Head() == nil {
+		t.Fatalf("Tar2git did not commit")
+	}
+}
+
+func TestResolveTree(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	if _, err := Tar2git(bytes.NewReader(src), tmp, "test", ""); err == nil {
+		t.Fatalf("Tar2git should reject a branch name which is not a reference")
+	}
+	treeHash, err := Tar2git(bytes.NewReader(src), tmp, "refs/heads/test", "images/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	commitHash := db.Head().String()
+	for _, name := range []string{"refs/heads/test", "test", commitHash, commitHash[:7], treeHash, treeHash[:7]} {
+		tree, err := ResolveTree(db.Repo(), name, "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tree.Id().String() != treeHash {
+			t.Fatalf("%s: resolved to %v, expected %s", name, tree.Id(), treeHash)
+		}
+		tree.Free()
+		var out bytes.Buffer
+		if err := Git2tar(tmp, name, "images/1", &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(src, out.Bytes()) {
+			t.Fatalf("%s: exported archive differs from the original", name)
+		}
+		data, err := OpenTree(tmp, name, path.Join("images/1", DataTree))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		names, err := data.List("a")
+		data.Free()
+		if err != nil || fmt.Sprintf("%v", names) != "[x]" {
+			t.Fatalf("%s: %v, %v", name, names, err)
+		}
+		packed, err := OpenTree(tmp, name, "images/1")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		err = ValidateTarTree(packed)
+		packed.Free()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if _, err := OpenTree(tmp, "0000000", ""); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("OpenTree: expected ErrNotExist, got %v", err)
+	}
+	for _, name := range []string{"refs/heads/nope", "0000000", ""} {
+		if _, err := ResolveTree(db.Repo(), name, ""); err == nil {
+			t.Fatalf("%q should not resolve", name)
+		}
+	}
+	if _, err := ResolveTree(db.Repo(), "test", "images/2"); err == nil {
+		t.Fatalf("missing scope should not resolve")
+	}
+}
+
+func TestTarEmptyDirectories(t *testing.T) {
+	for _, src := range [][]byte{
+		mkTar(t,
+			tarEntry{&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+			tarEntry{&tar.Header{Name: "proc/", Typeflag: tar.TypeDir, Mode: 0555}, ""},
+			tarEntry{&tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777}, ""},
+			tarEntry{&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+			tarEntry{&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "host"},
+			tarEntry{&tar.Header{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+			tarEntry{&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}, ""},
+		),
+		// Only empty directories
+		mkTar(t,
+			tarEntry{&tar.Header{Name: "empty/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		),
+		// Directories implied by their contents
+		mkTar(t,
+			tarEntry{&tar.Header{Name: "a/b/c", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "c"},
+		),
+	} {
+		assertTarEqual(t, readTar(t, src), tarRoundTrip(t, src))
+	}
+}
+
+func TestTarLayers(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	base := mkTar(t,
+		tarEntry{&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "a"},
+		tarEntry{&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "b"},
+	)
+	layer := mkTar(t,
+		tarEntry{&tar.Header{Name: ".wh.a", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "c", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "c"},
+	)
+	head1, err := db.ImportTarLayer(bytes.NewReader(base), "", "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The parent doesn't match
+	if _, err := db.ImportTarLayer(bytes.NewReader(layer), "", "layer"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("import on top of the wrong parent: expected ErrConflict, got %v", err)
+	}
+	if !db.Head().Equal(head1) {
+		t.Fatalf("failed import moved the head")
+	}
+	head2, err := db.ImportTarLayer(bytes.NewReader(layer), head1.String(), "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.commit.ParentCount() != 1 || !db.commit.ParentId(0).Equal(head1) {
+		t.Fatalf("%v is not on top of %v", head2, head1)
+	}
+	names, err := db.List(DataTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", names) != "[b c]" {
+		t.Fatalf("%v", names)
+	}
+}
+
+type recordingLogger []string
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, args...))
+}
+
+// captureOutput runs f, and returns what it wrote to os.Stdout and
+// os.Stderr.
+func captureOutput(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- string(data)
+	}()
+	f()
+	os.Stdout, os.Stderr = stdout, stderr
+	w.Close()
+	return <-output
+}
+
+func TestTarQuiet(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+	)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	output := captureOutput(t, func() {
+		hash, err := Tar2git(bytes.NewReader(src), tmp, "refs/heads/test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Git2tar(tmp, hash, "", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if output != "" {
+		t.Fatalf("unexpected output: %q", output)
+	}
+
+	db, err := Open(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	var logger recordingLogger
+	db.Scope("/").SetLogger(&logger)
+	if err := db.GetTar(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger) == 0 {
+		t.Fatalf("nothing was logged")
+	}
+}
+
+func TestTarSparse(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("GNU tar is required to generate sparse archives")
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	dir := path.Join(tmp, "src")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A file with a hole of 1MB followed by some data
+	f, err := os.Create(path.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("hello"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := ioutil.WriteFile(path.Join(dir, "zafter"), []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := exec.Command("tar", "--format=gnu", "--sparse", "-C", dir, "-cf", "-", "sparse", "zafter").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := tarRoundTrip(t, src)
+	if len(entries) != 2 {
+		t.Fatalf("%#v", entries)
+	}
+	expected := string(make([]byte, 1<<20)) + "hello"
+	if entries[0].hdr.Typeflag != tar.TypeReg || entries[0].data != expected {
+		t.Fatalf("sparse file was not expanded: %v, %d bytes", entries[0].hdr.Typeflag, len(entries[0].data))
+	}
+	if entries[1].hdr.Name != "zafter" || entries[1].data != "after" {
+		t.Fatalf("entry after the sparse file was corrupted: %#v", entries[1])
+	}
+}
+
+func TestTarChunked(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 16<<20)
+	for i := range data {
+		data[i] = byte(rnd.Int63())
+	}
+	mkImage := func(data []byte) []byte {
+		return mkTar(t,
+			tarEntry{&tar.Header{Name: "disk.img", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}, string(data)},
+			tarEntry{&tar.Header{Name: "small", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, "small"},
+		)
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	opts := &TarOptions{ChunkThreshold: 1 << 20}
+	stats, err := db.SetTarWithOptions(bytes.NewReader(mkImage(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NewBlobs < 4 {
+		t.Fatalf("16MB file stored in %d blobs", stats.NewBlobs-1)
+	}
+	// Modify a few bytes in the middle of the file
+	copy(data[len(data)/2:], "modified")
+	src := mkImage(data)
+	if stats, err = db.SetTarWithOptions(bytes.NewReader(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	if stats.NewBlobs > 2 {
+		t.Fatalf("re-import wrote %d new chunks: %#v", stats.NewBlobs, stats)
+	}
+	if err := ValidateTarTree(db); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := db.GetTar(&out); err != nil {
+		t.Fatal(err)
+	}
+	assertTarEqual(t, readTar(t, src), readTar(t, out.Bytes()))
+}
+
+func TestDeterministicCommits(t *testing.T) {
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/b", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, "hello"},
+	)
+	var heads []string
+	for i := 0; i < 2; i++ {
+		tmp := tmpdir(t)
+		defer os.RemoveAll(tmp)
+		db, err := Init(tmp, "refs/heads/test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Free()
+		db.SetClock(DeterministicCommits)
+		if err := db.ImportTar(bytes.NewReader(src), "import"); err != nil {
+			t.Fatal(err)
+		}
+		heads = append(heads, db.Head().String())
+		entries, err := db.Log(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !entries[0].Time.Equal(time.Unix(0, 0)) {
+			t.Fatalf("commit time is %v", entries[0].Time)
+		}
+		// Let the clock tick between the imports
+		time.Sleep(1100 * time.Millisecond)
+	}
+	if heads[0] != heads[1] {
+		t.Fatalf("identical imports committed %s and %s", heads[0], heads[1])
+	}
+}
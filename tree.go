@@ -2,7 +2,7 @@ package libpack
 
 import (
 	"fmt"
-	"path"
+	"strings"
 
 	git "github.com/libgit2/git2go"
 )
@@ -14,121 +14,212 @@ import (
 // it is overwritten.
 //
 // Since git trees are immutable, base is not modified. The new
-// tree is returned.
+// tree is returned, and must be freed by the caller.
 // If an error is encountered, intermediary objects may be left
 // behind in the git repository. It is the caller's responsibility
 // to perform garbage collection, if any.
 // FIXME: manage garbage collection, or provide a list of created
 // objects.
 func TreeUpdate(repo *git.Repository, tree *git.Tree, key string, valueId *git.Oid) (t *git.Tree, err error) {
-	/*
-	** // Primitive but convenient tracing for debugging recursive calls to TreeUpdate.
-	** // Uncomment this block for debug output.
-	**
-	** var callString string
-	** if tree != nil {
-	** 		callString = fmt.Sprintf("   TreeUpdate %v:\t\t%s\t\t\t= %v", tree.Id(), key, valueId)
-	** 	} else {
-	** 		callString = fmt.Sprintf("   TreeUpdate %v:\t\t%s\t\t\t= %v", tree, key, valueId)
-	** 	}
-	** 	fmt.Printf("   %s\n", callString)
-	** 	defer func() {
-	** 		if t != nil {
-	** 			fmt.Printf("-> %s => %v\n", callString, t.Id())
-	** 		} else {
-	** 			fmt.Printf("-> %s => %v\n", callString, err)
-	** 		}
-	** 	}()
-	 */
+	return treeUpdate(repo, tree, key, valueId, 0100644)
+}
+
+// treeUpdate is like TreeUpdate, but blobs are inserted with the git
+// filemode `mode` (for example 0100755 or 0120000) instead of the
+// regular file default. Subtrees are always inserted as 040000.
+//
+// The path to `key` is walked down once, and each directory along it
+// is written exactly once, bottom-up.
+func treeUpdate(repo *git.Repository, tree *git.Tree, key string, valueId *git.Oid, mode int) (*git.Tree, error) {
 	key = TreePath(key)
-	base, leaf := path.Split(key)
 	o, err := repo.Lookup(valueId)
 	if err != nil {
 		return nil, err
 	}
-	var builder *git.TreeBuilder
-	if tree == nil {
-		builder, err = repo.TreeBuilder()
+	defer o.Free()
+	var value *git.Tree
+	switch v := o.(type) {
+	case *git.Blob:
+	case *git.Tree:
+		value = v
+	default:
+		return nil, fmt.Errorf("value must be a blob or subtree")
+	}
+	// The key is /: we're replacing the current tree, merging the
+	// new one in.
+	if key == "/" {
+		if value == nil {
+			return nil, fmt.Errorf("value at / must be a subtree")
+		}
+		if tree == nil {
+			return lookupTree(repo, valueId)
+		}
+		id, err := treeMerge(repo, tree, value)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		builder, err = repo.TreeBuilderFromTree(tree)
+		return lookupTree(repo, id)
+	}
+	// Walk down to the parent directory of the key, opening a builder
+	// for each level. Missing directories, or other objects in the
+	// way, are replaced with new directories.
+	parts := strings.Split(key, "/")
+	builders := make([]*git.TreeBuilder, len(parts))
+	defer func() {
+		for _, builder := range builders {
+			if builder != nil {
+				builder.Free()
+			}
+		}
+	}()
+	dir := tree
+	for i, name := range parts {
+		if dir == nil {
+			builders[i], err = repo.TreeBuilder()
+		} else {
+			builders[i], err = repo.TreeBuilderFromTree(dir)
+		}
+		if err != nil {
+			if dir != tree && dir != nil {
+				dir.Free()
+			}
+			return nil, err
+		}
+		next, err := subtree(repo, dir, name)
+		if dir != tree && dir != nil {
+			dir.Free()
+		}
 		if err != nil {
 			return nil, err
 		}
+		dir = next
+	}
+	// `dir` is now the existing subtree at `key`, if any: a new
+	// subtree is merged into it.
+	id, entryMode := valueId, mode
+	if value != nil {
+		entryMode = 040000
+		if dir != nil {
+			id, err = treeMerge(repo, dir, value)
+		}
+	}
+	if dir != nil {
+		dir.Free()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Write each directory, bottom-up.
+	for i := len(parts) - 1; i >= 0; i-- {
+		if err := builders[i].Insert(parts[i], id, entryMode); err != nil {
+			return nil, err
+		}
+		if id, err = builders[i].Write(); err != nil {
+			return nil, err
+		}
+		entryMode = 040000
+	}
+	return lookupTree(repo, id)
+}
+
+// subtree returns the subtree `name` of `tree`, or nil if `tree` is nil
+// or has no subtree by that name. The caller must free the result.
+func subtree(repo *git.Repository, tree *git.Tree, name string) (*git.Tree, error) {
+	if tree == nil {
+		return nil, nil
+	}
+	e := tree.EntryByName(name)
+	if e == nil || e.Type != git.ObjectTree {
+		return nil, nil
+	}
+	return lookupTree(repo, e.Id)
+}
+
+// treeMerge writes the tree resulting from merging `src` into `dst`:
+// entries of `src` overwrite those of `dst`, except that subtrees
+// present in both are merged recursively.
+func treeMerge(repo *git.Repository, dst, src *git.Tree) (*git.Oid, error) {
+	builder, err := repo.TreeBuilderFromTree(dst)
+	if err != nil {
+		return nil, err
 	}
 	defer builder.Free()
-	// The specified path has only 1 component (the "leaf")
-	if base == "" || base == "/" {
-		// If val is a string, set it and we're done.
-		// Any old value is overwritten.
-		if _, isBlob := o.(*git.Blob); isBlob {
-			if err := builder.Insert(leaf, valueId, 0100644); err != nil {
-				return nil, err
-			}
-			newTreeId, err := builder.Write()
+	for i := uint64(0); i < src.EntryCount(); i++ {
+		e := src.EntryByIndex(i)
+		id := e.Id
+		if e.Type == git.ObjectTree {
+			old, err := subtree(repo, dst, e.Name)
 			if err != nil {
 				return nil, err
 			}
-			newTree, err := lookupTree(repo, newTreeId)
-			if err != nil {
-				return nil, err
-			}
-			return newTree, nil
-		}
-		// If val is not a string, it must be a subtree.
-		// Return an error if it's any other type than Tree.
-		oTree, ok := o.(*git.Tree)
-		if !ok {
-			return nil, fmt.Errorf("value must be a blob or subtree")
-		}
-		var subTree *git.Tree
-		var oldSubTree *git.Tree
-		if tree != nil {
-			oldSubTree, err = lookupSubtree(repo, tree, leaf)
-			// FIXME: distinguish "no such key" error (which
-			// FIXME: distinguish a non-existing previous tree (continue with oldTree==nil)
-			// from other errors (abort and return an error)
-			if err == nil {
-				defer oldSubTree.Free()
-			}
-		}
-		// If that subtree already exists, merge the new one in.
-		if oldSubTree != nil {
-			subTree = oldSubTree
-			for i := uint64(0); i < oTree.EntryCount(); i++ {
-				var err error
-				e := oTree.EntryByIndex(i)
-				subTree, err = TreeUpdate(repo, subTree, e.Name, e.Id)
+			if old != nil {
+				newSrc, err := lookupTree(repo, e.Id)
+				if err != nil {
+					old.Free()
+					return nil, err
+				}
+				id, err = treeMerge(repo, old, newSrc)
+				old.Free()
+				newSrc.Free()
 				if err != nil {
 					return nil, err
 				}
 			}
-		} else {
-			subTree = oTree
 		}
-		// If the key is /, we're replacing the current tree
-		if key == "/" {
-			return subTree, nil
+		if err := builder.Insert(e.Name, id, e.Filemode); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Write()
+}
+
+// TreeDelete creates a new Git tree by removing the object at the
+// specified path, if any. Subtrees left empty by the removal are kept.
+//
+// Since git trees are immutable, tree is not modified. The new tree
+// is returned, and must be freed by the caller.
+func TreeDelete(repo *git.Repository, tree *git.Tree, key string) (*git.Tree, error) {
+	key = TreePath(key)
+	if key == "/" {
+		empty, err := emptyTree(repo)
+		if err != nil {
+			return nil, err
 		}
-		// Otherwise we're inserting into the current tree
-		if err := builder.Insert(leaf, subTree.Id(), 040000); err != nil {
+		return lookupTree(repo, empty)
+	}
+	parts := strings.SplitN(key, "/", 2)
+	e := tree.EntryByName(parts[0])
+	if e == nil || (len(parts) == 2 && e.Type != git.ObjectTree) {
+		// Nothing to delete
+		return lookupTree(repo, tree.Id())
+	}
+	builder, err := repo.TreeBuilderFromTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+	if len(parts) == 1 {
+		if err := builder.Remove(parts[0]); err != nil {
 			return nil, err
 		}
-		newTreeId, err := builder.Write()
+	} else {
+		subTree, err := lookupTree(repo, e.Id)
 		if err != nil {
 			return nil, err
 		}
-		newTree, err := lookupTree(repo, newTreeId)
+		defer subTree.Free()
+		newSubTree, err := TreeDelete(repo, subTree, parts[1])
 		if err != nil {
 			return nil, err
 		}
-		return newTree, nil
+		defer newSubTree.Free()
+		if err := builder.Insert(parts[0], newSubTree.Id(), 040000); err != nil {
+			return nil, err
+		}
 	}
-	subtree, err := TreeUpdate(repo, nil, leaf, valueId)
+	newTreeId, err := builder.Write()
 	if err != nil {
 		return nil, err
 	}
-	return TreeUpdate(repo, tree, base, subtree.Id())
+	return lookupTree(repo, newTreeId)
 }
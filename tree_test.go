@@ -0,0 +1,92 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+// dumpTree returns a listing of `tree`, with the contents and filemode
+// of each blob.
+func dumpTree(t *testing.T, r *git.Repository, tree *git.Tree) string {
+	var out string
+	err := tree.Walk(func(parent string, e *git.TreeEntry) int {
+		if e.Type == git.ObjectTree {
+			out += fmt.Sprintf("%s%s/\n", parent, e.Name)
+			return 0
+		}
+		blob, err := r.LookupBlob(e.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Free()
+		out += fmt.Sprintf("%s%s = %s (%o)\n", parent, e.Name, blob.Contents(), e.Filemode)
+		return 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestTreeUpdate(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	r, err := git.InitRepository(tmp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Free()
+	blob := func(value string) *git.Oid {
+		id, err := r.CreateBlobFromBuffer([]byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	var tree *git.Tree
+	set := func(key string, id *git.Oid, mode int) {
+		if tree, err = treeUpdate(r, tree, key, id, mode); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+	set("a/b/c", blob("1"), 0100644)
+	set("a/b/d", blob("2"), 0100755)
+	set("a/e", blob("3"), 0100644)
+	// A blob in the way is replaced with a directory
+	set("a/e/f", blob("4"), 0100644)
+	// Setting a subtree merges it with the existing one
+	var other *git.Tree
+	if other, err = treeUpdate(r, nil, "b/d", blob("5"), 0100644); err != nil {
+		t.Fatal(err)
+	}
+	if other, err = treeUpdate(r, other, "g", blob("6"), 0100644); err != nil {
+		t.Fatal(err)
+	}
+	set("a", other.Id(), 0)
+	expected := "" +
+		"a/\n" +
+		"a/b/\n" +
+		"a/b/c = 1 (100644)\n" +
+		"a/b/d = 5 (100644)\n" +
+		"a/e/\n" +
+		"a/e/f = 4 (100644)\n" +
+		"a/g = 6 (100644)\n"
+	if dump := dumpTree(t, r, tree); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+	// Setting a subtree at / merges it with the whole tree
+	set("/", other.Id(), 0)
+	expected += "" +
+		"b/\n" +
+		"b/d = 5 (100644)\n" +
+		"g = 6 (100644)\n"
+	if dump := dumpTree(t, r, tree); dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+	if _, err := treeUpdate(r, tree, "/", blob("7"), 0100644); err == nil {
+		t.Fatalf("setting a blob at / should fail")
+	}
+}
@@ -0,0 +1,149 @@
+package libpack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
+)
+
+// ValidateTarTree checks that the tar import stored in db is consistent:
+// every entry of the data tree has parseable metadata describing it,
+// file sizes match the size of their blob, hardlink targets exist, and
+// no metadata describes a file whose data is missing.
+// All problems found are reported in the returned error.
+func ValidateTarTree(db *DB) error {
+	if db.Latest() == nil {
+		return fmt.Errorf("no tree to validate")
+	}
+	view, release, err := db.tarView()
+	if err != nil {
+		return err
+	}
+	defer release()
+	db = view
+	var problems []string
+	report := func(name, msg string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", name, fmt.Sprintf(msg, args...)))
+	}
+	seen := make(map[string]bool)
+	// Hardlink targets are checked once all the data is seen
+	var links []*tar.Header
+	if _, err := db.entry(DataTree); err == nil {
+		err := db.Walk(DataTree, func(key string, obj git.Object) error {
+			name, err := dataName(key)
+			if err != nil {
+				report(key, "invalid name")
+				return SkipTree
+			}
+			seen[name] = true
+			metaBlob, err := db.getMeta(name)
+			if err != nil {
+				if _, isTree := obj.(*git.Tree); !isTree {
+					report(name, "no metadata")
+				}
+				return nil
+			}
+			hdr, err := decodeHeader(metaBlob)
+			if err != nil {
+				report(name, "%v", err)
+				return nil
+			}
+			if TreePath(hdr.Name) != name {
+				report(name, "metadata describes %s", hdr.Name)
+			}
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				if tree, isTree := obj.(*git.Tree); isTree {
+					if size, err := db.chunkedSize(name, tree); err != nil {
+						report(name, "%v", err)
+					} else if size != hdr.Size {
+						report(name, "chunks are %d bytes, metadata says %d", size, hdr.Size)
+					}
+				} else if blob, isBlob := obj.(*git.Blob); !isBlob {
+					report(name, "regular file stored as a %v", obj.Type())
+				} else if blob.Size() != hdr.Size {
+					report(name, "blob is %d bytes, metadata says %d", blob.Size(), hdr.Size)
+				}
+			case tar.TypeLink:
+				links = append(links, hdr)
+			case tar.TypeDir:
+				if _, isTree := obj.(*git.Tree); !isTree {
+					report(name, "directory stored as a %v", obj.Type())
+				}
+				return nil
+			}
+			if _, isTree := obj.(*git.Tree); isTree {
+				// The chunks of a file are not entries of their own
+				return SkipTree
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, hdr := range links {
+		if !seen[TreePath(hdr.Linkname)] {
+			report(TreePath(hdr.Name), "hardlink target %s does not exist", hdr.Linkname)
+		}
+	}
+	err = db.walkAnnotations(MetaTree, func(name string, blob *git.Blob) error {
+		if seen[name] {
+			return nil
+		}
+		hdr, err := decodeHeader(string(blob.Contents()))
+		if err != nil {
+			report(name, "%v", err)
+			return nil
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			report(name, "metadata for a file without data")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found:\n%s", len(problems), strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// ValidateRoundTrip imports the tar stream `src` in a new tree of the
+// repository `r`, exports it again, and checks that the result is
+// identical to `src`. No reference of `r` is modified.
+// `src` is read twice: once to compute its checksum, and once to import it.
+func ValidateRoundTrip(src io.ReadSeeker, r *git.Repository) error {
+	expected := sha256.New()
+	if _, err := io.Copy(expected, src); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return err
+	}
+	// Not created with newRepo: the database must not free `r`,
+	// only the trees it creates.
+	db := &DB{repo: r}
+	defer db.setTree(nil)
+	if err := db.SetTar(src); err != nil {
+		return fmt.Errorf("import: %v", err)
+	}
+	if err := ValidateTarTree(db); err != nil {
+		return err
+	}
+	actual := sha256.New()
+	if err := db.GetTar(actual); err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+	if !bytes.Equal(expected.Sum(nil), actual.Sum(nil)) {
+		return fmt.Errorf("exported stream differs: sha256 %x, expected %x", actual.Sum(nil), expected.Sum(nil))
+	}
+	return nil
+}
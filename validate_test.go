@@ -0,0 +1,81 @@
+package libpack
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
+)
+
+func TestValidateTarTree(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "xxx"},
+		tarEntry{&tar.Header{Name: "a/link", Typeflag: tar.TypeLink, Linkname: "a/x", Mode: 0644}, ""},
+		tarEntry{&tar.Header{Name: "y", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, "yy"},
+	)
+	if err := db.SetTar(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTarTree(db); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the tree in every way the validation checks
+	if err := db.Set("_fs_data/nometa", "data"); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := headerReader(&tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 10, ModTime: time.Unix(1400000000, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetStream(metaPath("a/x"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("_fs_data/y"); err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateTarTree(db)
+	if err == nil {
+		t.Fatalf("validation should fail")
+	}
+	for _, problem := range []string{
+		"nometa: no metadata",
+		"a/x: blob is 3 bytes, metadata says 10",
+		"y: metadata for a file without data",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q not reported in: %v", problem, err)
+		}
+	}
+}
+
+func TestValidateRoundTrip(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	src := mkTar(t,
+		tarEntry{&tar.Header{Name: "z/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		tarEntry{&tar.Header{Name: "z/x", Typeflag: tar.TypeReg, Mode: 0755, Size: 3}, "xxx"},
+		tarEntry{&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "z/x", Mode: 0777}, ""},
+	)
+	if err := ValidateRoundTrip(bytes.NewReader(src), db.Repo()); err != nil {
+		t.Fatal(err)
+	}
+	if db.Head() != nil {
+		t.Fatalf("ValidateRoundTrip should not commit")
+	}
+}
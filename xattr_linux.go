@@ -0,0 +1,28 @@
+package libpack
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileXattrs returns the extended attributes of the file at `p` which
+// docker's archive.TarWithOptions stores: only "security.capability".
+// Those of symlinks are not read, since the syscall package has no
+// lgetxattr.
+func fileXattrs(p string, isLink bool) (map[string]string, error) {
+	if isLink {
+		return nil, nil
+	}
+	const name = "security.capability"
+	size, err := syscall.Getxattr(p, name, nil)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: p, Err: err}
+	}
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(p, name, value); err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: p, Err: err}
+	}
+	return map[string]string{name: string(value[:size])}, nil
+}
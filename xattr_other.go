@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package libpack
+
+// fileXattrs returns the extended attributes of the file at `p` which
+// docker's archive.TarWithOptions stores. They are only read on Linux.
+func fileXattrs(p string, isLink bool) (map[string]string, error) {
+	return nil, nil
+}